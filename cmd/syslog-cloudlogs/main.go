@@ -1,26 +1,44 @@
 package main
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"expvar"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/versent/syslog-cloudlogs/pkg/batching"
 	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/connlimit"
 	"github.com/versent/syslog-cloudlogs/pkg/cwlogs"
+	"github.com/versent/syslog-cloudlogs/pkg/forward"
+	"github.com/versent/syslog-cloudlogs/pkg/framing"
+	"github.com/versent/syslog-cloudlogs/pkg/gelf"
+	"github.com/versent/syslog-cloudlogs/pkg/httpinput"
+	"github.com/versent/syslog-cloudlogs/pkg/proxyproto"
+	"github.com/versent/syslog-cloudlogs/pkg/relp"
+	"github.com/versent/syslog-cloudlogs/pkg/sourceacl"
+	"github.com/versent/syslog-cloudlogs/pkg/spool"
+	"github.com/versent/syslog-cloudlogs/pkg/tlsconfig"
+	"github.com/versent/syslog-cloudlogs/pkg/unixsocket"
 	syslog "github.com/wolfeidau/go-syslog"
-	"github.com/wolfeidau/proxyv2"
+	"github.com/wolfeidau/go-syslog/format"
 )
 
-const (
-	batchSize     = 900000
-	batchDuration = 250 * time.Millisecond
-)
+const batchDuration = 250 * time.Millisecond
+
+// service a server accepting messages on a listener
+type service interface {
+	Boot() error
+	Wait()
+}
 
 var (
 	// Version program version which is updated via build flags
@@ -32,7 +50,7 @@ func main() {
 
 	logrus.SetFormatter(&logrus.JSONFormatter{})
 
-	err := envconfig.Process("syslog", &c)
+	err := c.Process("syslog")
 	if err != nil {
 		logrus.Fatal(err.Error())
 	}
@@ -48,8 +66,11 @@ func main() {
 
 	logrus.WithField("version", version).Info("service starting")
 
+	if c.MetricsPort != 0 {
+		go serveMetrics(c.MetricsPort)
+	}
+
 	channel := make(syslog.LogPartsChannel)
-	handler := syslog.NewChannelHandler(channel)
 
 	dispatcher, err := cwlogs.NewDispatcher(&c)
 	if err != nil {
@@ -61,113 +82,531 @@ func main() {
 		logrus.Fatal(err.Error())
 	}
 
-	batcher := batching.NewBatcher(batchSize, batchDuration, dispatcher.Dispatch)
+	dispatch := batching.DispatchFunc(dispatcher.Dispatch)
+
+	// batches are written to the spool and uploaded from there, starting with any left from before a restart
+	if c.SpoolDir != "" {
+		sp, err := spool.Open(&c, dispatcher.Dispatch)
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+
+		go sp.Run()
+		go closeOnSignal(sp)
+
+		dispatch = sp.Append
+	}
+
+	batcher := batching.NewBatcher(batching.MaxBatchSize, batchDuration, dispatch)
+
+	servers := []service{}
+	stores := []*tlsconfig.Store{}
+
+	for _, lc := range c.ListenerConfigs() {
+		server, store, err := setupListener(lc, channel, batcher)
+		if err != nil {
+			logrus.WithField("listener", lc.Name).Fatal(err.Error())
+		}
+
+		servers = append(servers, server)
+
+		if store != nil {
+			stores = append(stores, store)
+		}
+	}
+
+	go reloadOnSignal(stores)
+
+	for _, server := range servers {
+		err = server.Boot()
+		if err != nil {
+			logrus.Fatal(err.Error())
+		}
+	}
+
+	go batcher.Handler(channel)
+
+	for _, server := range servers {
+		server.Wait()
+	}
+}
+
+// serveMetrics serve the expvar metrics on /debug/vars
+func serveMetrics(port int) {
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	logrus.WithField("addr", addr).Info("metrics listen")
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		logrus.WithError(err).Error("metrics listener failed")
+	}
+}
+
+// reloadOnSignal reload the TLS configuration of all listeners on SIGHUP
+func reloadOnSignal(stores []*tlsconfig.Store) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logrus.Info("reloading TLS configuration")
+
+		for _, store := range stores {
+			err := store.Reload()
+			if err != nil {
+				logrus.WithError(err).Error("TLS configuration reload failed")
+			}
+		}
+	}
+}
+
+// closeOnSignal close the spool and exit on SIGINT or SIGTERM, so the current segment is synced and
+// the checkpoint of the batch being dispatched is written before stopping
+func closeOnSignal(sp *spool.Spool) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-signals
+
+	logrus.WithField("signal", sig.String()).Info("service stopping")
+
+	err := sp.Close()
+	if err != nil {
+		logrus.WithError(err).Error("spool close failed")
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+// setupListener create a server for the listener which tags messages with the listener they arrived on,
+// TLS listeners also return the store holding their TLS configuration
+func setupListener(lc *config.ListenerConfig, channel syslog.LogPartsChannel, batcher *batching.Batcher) (service, *tlsconfig.Store, error) {
+	tagger := &listenerTagger{listener: lc.Name, transport: lc.Transport}
+	submitter := &taggedSubmitter{batcher: batcher, tagger: tagger}
+
+	switch lc.Transport {
+	case config.TransportRELP, config.TransportRELPTLS:
+		return setupRELPListener(lc, submitter)
+	case config.TransportHTTP, config.TransportHTTPS:
+		return setupHTTPListener(lc, submitter)
+	case config.TransportGELFTCP, config.TransportGELFUDP:
+		return setupGELFListener(lc, submitter)
+	case config.TransportForward, config.TransportForwardTLS:
+		return setupForwardListener(lc, submitter)
+	}
 
 	server := syslog.NewServer()
-	server.SetFormat(syslog.Automatic)
+	server.SetFormat(framing.NewFormat(lc))
+	handler := &listenerHandler{channel: channel, tagger: tagger}
 	server.SetHandler(handler)
-	server.SetTlsPeerNameFunc(tlsPeerFunc)
 
-	err = setupTLSListener(&c, server)
+	var (
+		store *tlsconfig.Store
+		err   error
+	)
+
+	switch lc.Transport {
+	case config.TransportTLS:
+		server.SetTlsPeerNameFunc(tlsconfig.PeerNameFunc(lc))
+		store, err = setupTLSListener(lc, server, tagger)
+	case config.TransportTCP:
+		err = setupTCPListener(lc, server, tagger)
+	case config.TransportUDP:
+		err = setupUDPListener(lc, server, handler)
+	case config.TransportUnix:
+		err = setupUnixListener(lc, server, tagger)
+	case config.TransportUnixgram:
+		err = setupUnixgramListener(lc, server)
+	default:
+		err = fmt.Errorf("unsupported transport %s", lc.Transport)
+	}
+
+	return server, store, err
+}
+
+func setupTLSListener(lc *config.ListenerConfig, server *syslog.Server, tagger *listenerTagger) (*tlsconfig.Store, error) {
+
+	store, err := tlsconfig.NewStore(lc)
 	if err != nil {
-		logrus.Fatal(err.Error())
+		return nil, err
+	}
+
+	if lc.CertRefresh > 0 {
+		go store.Refresh(lc.CertRefresh)
 	}
 
-	err = server.Boot()
+	ln, err := buildListener(lc, tagger)
 	if err != nil {
-		logrus.Fatal(err.Error())
+		return nil, errors.Wrap(err, "failed to create listener")
 	}
 
-	go batcher.Handler(channel)
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("TLS listen")
+
+	tlsLn := tlsconfig.NewListener(ln, lc.Name, store.Config(), lc.HandshakeTimeout)
 
-	server.Wait()
+	err = server.Listen(tlsLn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to start TLS listener")
+	}
+
+	return store, nil
 }
 
-func setupTLSListener(conf *config.SyslogConfig, server *syslog.Server) error {
+func setupRELPListener(lc *config.ListenerConfig, submitter *taggedSubmitter) (service, *tlsconfig.Store, error) {
 
-	ln, err := buildListener(conf)
+	ln, store, err := buildServiceListener(lc, submitter.tagger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr(), "ack": lc.AckMode}).Info("RELP listen")
+
+	return relp.NewServer(lc, ln, submitter), store, nil
+}
+
+func setupHTTPListener(lc *config.ListenerConfig, submitter *taggedSubmitter) (service, *tlsconfig.Store, error) {
+
+	ln, store, err := buildServiceListener(lc, submitter.tagger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("HTTP listen")
+
+	return httpinput.NewServer(lc, ln, submitter), store, nil
+}
+
+func setupGELFListener(lc *config.ListenerConfig, submitter *taggedSubmitter) (service, *tlsconfig.Store, error) {
+
+	if lc.Transport == config.TransportGELFUDP {
+		filter, err := sourceacl.NewFilter(lc)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		conn, err := net.ListenPacket("udp", lc.Addr())
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "failed to start GELF UDP listener")
+		}
+
+		if filter != nil {
+			conn = sourceacl.NewPacketConn(conn, lc.Name, filter)
+		}
+
+		logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("GELF UDP listen")
+
+		return gelf.NewUDPServer(lc, conn, submitter), nil, nil
+	}
+
+	ln, store, err := buildServiceListener(lc, submitter.tagger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("GELF TCP listen")
+
+	return gelf.NewTCPServer(lc, ln, submitter), store, nil
+}
+
+func setupForwardListener(lc *config.ListenerConfig, submitter *taggedSubmitter) (service, *tlsconfig.Store, error) {
+
+	ln, store, err := buildServiceListener(lc, submitter.tagger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr(), "ack": lc.AckMode}).Info("forward listen")
+
+	return forward.NewServer(lc, ln, submitter), store, nil
+}
+
+// buildServiceListener create the listener for servers which handle their own connections,
+// wrapping it with TLS backed by a reloadable store for TLS transports
+func buildServiceListener(lc *config.ListenerConfig, tagger *listenerTagger) (net.Listener, *tlsconfig.Store, error) {
+
+	ln, err := buildListener(lc, tagger)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to create listener")
+	}
+
+	if !lc.IsTLS() {
+		return ln, nil, nil
+	}
+
+	store, err := tlsconfig.NewStore(lc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if lc.CertRefresh > 0 {
+		go store.Refresh(lc.CertRefresh)
+	}
+
+	return tlsconfig.NewListener(ln, lc.Name, store.Config(), lc.HandshakeTimeout), store, nil
+}
+
+func setupTCPListener(lc *config.ListenerConfig, server *syslog.Server, tagger *listenerTagger) error {
+
+	ln, err := buildListener(lc, tagger)
 	if err != nil {
 		return errors.Wrap(err, "failed to create listener")
 	}
 
-	cert, err := conf.Certificate()
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("TCP listen")
+
+	err = server.Listen(ln)
 	if err != nil {
-		return errors.Wrap(err, "failed to build certs from configuration")
+		return errors.Wrap(err, "failed to start TCP listener")
 	}
 
-	caCert, err := conf.ClientCaCertificate()
+	return nil
+}
+
+func setupUDPListener(lc *config.ListenerConfig, server *syslog.Server, handler *listenerHandler) error {
+
+	// the server reads the datagrams itself so they're filtered once parsed
+	filter, err := sourceacl.NewFilter(lc)
 	if err != nil {
-		return errors.Wrap(err, "failed to build ca cert from configuration")
+		return err
 	}
 
-	caCertPool := x509.NewCertPool()
-	caCertPool.AppendCertsFromPEM(caCert)
+	handler.filter = filter
 
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},        // server certificate which is validated by the client
-		ClientCAs:    caCertPool,                     // used to verify the client cert is signed by the CA and is therefore valid
-		ClientAuth:   tls.RequireAndVerifyClientCert, // this requires a valid client certificate to be supplied during handshake
+	err = server.ListenUDP(lc.Addr())
+	if err != nil {
+		return errors.Wrap(err, "failed to start UDP listener")
 	}
 
-	tlsLn := tls.NewListener(ln, config)
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "addr": lc.Addr()}).Info("UDP listen")
 
-	err = server.Listen(tlsLn)
+	return nil
+}
+
+func setupUnixListener(lc *config.ListenerConfig, server *syslog.Server, tagger *listenerTagger) error {
+
+	ln, err := unixsocket.Listen(lc)
 	if err != nil {
-		return errors.Wrap(err, "failed to start TLS listener")
+		return err
 	}
 
+	limiter := connlimit.NewLimiter(lc)
+
+	tagger.limiter = limiter
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "path": lc.Path}).Info("UNIX stream listen")
+
+	err = server.Listen(connlimit.NewListener(ln, limiter))
+	if err != nil {
+		return errors.Wrap(err, "failed to start UNIX stream listener")
+	}
+
+	return nil
+}
+
+func setupUnixgramListener(lc *config.ListenerConfig, server *syslog.Server) error {
+
+	err := unixsocket.RemoveStale(lc.Path, config.TransportUnixgram)
+	if err != nil {
+		return err
+	}
+
+	err = server.ListenUnixgram(lc.Path)
+	if err != nil {
+		return errors.Wrap(err, "failed to start UNIX datagram listener")
+	}
+
+	err = unixsocket.SetPermissions(lc)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{"listener": lc.Name, "path": lc.Path}).Info("UNIX datagram listen")
+
 	return nil
 }
 
-func buildListener(conf *config.SyslogConfig) (net.Listener, error) {
+// buildListener create a TCP listener, when proxying the tagger is given the metadata decoded from the TLVs of each connection,
+// connections from sources which aren't permitted are closed before any data is exchanged and the tagger is given the
+// limiter which throttles the messages of each connection
+func buildListener(lc *config.ListenerConfig, tagger *listenerTagger) (net.Listener, error) {
 
-	addr := fmt.Sprintf(":%v", conf.Port)
+	filter, err := sourceacl.NewFilter(lc)
+	if err != nil {
+		return nil, err
+	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := net.Listen("tcp", lc.Addr())
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create TCP listener")
 	}
 
-	logrus.WithField("addr", addr).Info("TLS listen")
+	limiter := connlimit.NewLimiter(lc)
+
+	tagger.limiter = limiter
 
-	// if we aren't proxying just return ln
-	if !conf.Proxy {
-		return ln, nil
+	if lc.Proxy {
+		// connections waiting for their header count against the listener limit, so clients which never
+		// send one can't exhaust file descriptors
+		ln = connlimit.NewConnectionListener(ln, limiter)
+
+		proxyLn := proxyproto.NewListener(ln, &proxyproto.Config{
+			Trace:            traceProxyHeaders,
+			ProxyHeaderError: proxyHeaderError,
+		})
+
+		tagger.metadata = proxyLn.Metadata
+
+		ln = proxyLn
 	}
 
-	proxyLn, err := proxyv2.NewListener(ln, &proxyv2.Config{
-		Trace:            traceProxyHeaders,
-		ProxyHeaderError: proxyHeaderError,
-	})
+	// when proxying the source is taken from the proxy header, it is checked on the first read rather than in accept
+	if filter != nil {
+		ln = sourceacl.NewListener(ln, lc.Name, filter, lc.Proxy)
+	}
+
+	// when proxying only the source limit remains to be checked, once the header has been read
+	if lc.Proxy {
+		return connlimit.NewSourceListener(ln, limiter), nil
+	}
+
+	return connlimit.NewListener(ln, limiter), nil
+}
+
+// listenerTagger tags messages with the listener and transport they were received on, and
+// the metadata decoded from the proxy protocol TLVs of the connection they arrived on
+type listenerTagger struct {
+	listener  string
+	transport string
+	metadata  func(client string) map[string]string
+	limiter   *connlimit.Limiter
+}
+
+func (t *listenerTagger) tag(logParts map[string]interface{}) {
+	logParts["listener"] = t.listener
+	logParts["transport"] = t.transport
+
+	client, ok := logParts["client"].(string)
+	if !ok {
+		return
+	}
+
+	logParts["client_ip"] = proxyproto.ClientIP(client)
+
+	if t.metadata == nil {
+		return
+	}
+
+	for name, value := range t.metadata(client) {
+		logParts[name] = value
+	}
+}
+
+// wait blocks while the connection the message arrived on exceeds its message rate
+func (t *listenerTagger) wait(logParts map[string]interface{}) {
+	if t.limiter == nil {
+		return
+	}
+
+	client, ok := logParts["client"].(string)
+	if !ok {
+		return
+	}
+
+	t.limiter.Wait(client, 1)
+}
+
+// listenerHandler tags each message before passing it to the shared channel, dropping datagrams
+// from sources the filter doesn't permit
+type listenerHandler struct {
+	channel syslog.LogPartsChannel
+	tagger  *listenerTagger
+	filter  *sourceacl.Filter
+}
+
+func (h *listenerHandler) Handle(logParts format.LogParts, msgLen int64, err error) {
+	if h.filter != nil && !h.permits(logParts) {
+		return
+	}
+
+	h.tagger.tag(logParts)
+	h.tagger.wait(logParts)
+	h.channel <- logParts
+}
+
+func (h *listenerHandler) permits(logParts format.LogParts) bool {
+	client, _ := logParts["client"].(string)
+
+	// clients which aren't an address are only permitted when there are no allowed networks
+	addr, err := net.ResolveUDPAddr("udp", client)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to create proxy listener")
+		return h.filter.PermitsDatagram(h.tagger.listener, nil)
+	}
+
+	return h.filter.PermitsDatagram(h.tagger.listener, addr)
+}
+
+// taggedSubmitter tags each entry before submitting it to the batcher
+type taggedSubmitter struct {
+	batcher *batching.Batcher
+	tagger  *listenerTagger
+}
+
+func (s *taggedSubmitter) Submit(entries ...*batching.LogEntry) {
+	for _, entry := range entries {
+		s.tagger.tag(entry.Parts)
+		s.tagger.wait(entry.Parts)
 	}
 
-	return proxyLn, nil
+	s.batcher.Submit(entries...)
 }
 
-func tlsPeerFunc(tlsConn *tls.Conn) (tlsPeer string, ok bool) {
-	return "default", true
+func (s *taggedSubmitter) SubmitTimeout(timeout time.Duration, entries ...*batching.LogEntry) error {
+	for _, entry := range entries {
+		s.tagger.tag(entry.Parts)
+		s.tagger.wait(entry.Parts)
+	}
+
+	return s.batcher.SubmitTimeout(timeout, entries...)
 }
 
-func traceProxyHeaders(state *proxyv2.ProxyConn) {
+func traceProxyHeaders(conn *proxyproto.Conn) {
 
 	// skip logging health checks from NLB
-	if state.WriteCounter() == 0 {
+	if conn.IsLocal() || conn.ReadCounter() == 0 {
 		return
 	}
 
+	header, _ := conn.Header()
+
 	logrus.WithField("proxy", map[string]interface{}{
-		"source":       state.Info().V4Addr.SourceIP().String(),
-		"destination":  state.Info().V4Addr.DestIP().String(),
-		"bytesRead":    state.ReadCounter(),
-		"bytesWritten": state.WriteCounter(),
-		"TLVs":         fmt.Sprintf("%s", state.Info().TLVs),
+		"version":      header.Version,
+		"source":       addrString(header.Source),
+		"destination":  addrString(header.Destination),
+		"bytesRead":    conn.ReadCounter(),
+		"bytesWritten": conn.WriteCounter(),
+		"TLVs":         fmt.Sprintf("%s", header.TLVs),
 	}).Info("trace connection")
 }
 
 func proxyHeaderError(err error) {
+	// connections closed without sending anything are health checks
+	if err == io.EOF {
+		return
+	}
+
 	logrus.WithField("proxy", map[string]interface{}{
 		"error": err,
 	}).Info("proxy header")
 }
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
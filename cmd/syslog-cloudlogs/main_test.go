@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	syslog "github.com/wolfeidau/go-syslog"
+)
+
+func Test_WhenUDPListener(t *testing.T) {
+	// reserve a free port for the listener
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	lc := &config.ListenerConfig{Name: "udp_test", Transport: config.TransportUDP, Bind: "127.0.0.1", Port: port}
+
+	channel := make(syslog.LogPartsChannel, 1)
+
+	server, store, err := setupListener(lc, channel, nil)
+	require.Nil(t, err)
+	require.Nil(t, store)
+
+	require.Nil(t, server.Boot())
+	defer server.(*syslog.Server).Kill()
+
+	conn, err := net.Dial("udp", lc.Addr())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("<34>1 2018-10-11T22:14:15.003Z mymachine.example.com su - ID47 - udp message"))
+	require.Nil(t, err)
+
+	select {
+	case logParts := <-channel:
+		require.Equal(t, "udp_test", logParts["listener"])
+		require.Equal(t, config.TransportUDP, logParts["transport"])
+		require.Equal(t, "udp message", logParts["message"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the UDP message")
+	}
+}
+
+func Test_WhenUDPListenerRejectsSource(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	lc := &config.ListenerConfig{Name: "udp_test", Transport: config.TransportUDP, Bind: "127.0.0.1", Port: port, DenySources: []string{"127.0.0.0/8"}}
+
+	channel := make(syslog.LogPartsChannel, 1)
+
+	server, _, err := setupListener(lc, channel, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, server.Boot())
+	defer server.(*syslog.Server).Kill()
+
+	conn, err := net.Dial("udp", lc.Addr())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("<34>1 2018-10-11T22:14:15.003Z mymachine.example.com su - ID47 - udp message"))
+	require.Nil(t, err)
+
+	select {
+	case logParts := <-channel:
+		t.Fatalf("message from denied source %v received", logParts["client"])
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func Test_WhenProxyListenerConnectionLimit(t *testing.T) {
+	lc := &config.ListenerConfig{
+		Name:             "proxy_test",
+		Transport:        config.TransportTCP,
+		Bind:             "127.0.0.1",
+		Proxy:            true,
+		ConnectionLimits: config.ConnectionLimits{MaxConnections: 2},
+	}
+
+	ln, err := buildListener(lc, &listenerTagger{})
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// connections which never send a header count against the limit
+	for n := 0; n < 2; n++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.Nil(t, err)
+		defer conn.Close()
+	}
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+	defer conn.Close()
+
+	// the connection over the limit is closed by the listener
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = conn.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+}
+
+func Test_WhenListenerTagger(t *testing.T) {
+	tagger := &listenerTagger{listener: "relp", transport: config.TransportRELP}
+
+	logParts := map[string]interface{}{"client": "10.0.0.1:5140"}
+	tagger.tag(logParts)
+
+	require.Equal(t, "relp", logParts["listener"])
+	require.Equal(t, config.TransportRELP, logParts["transport"])
+	require.Equal(t, "10.0.0.1", logParts["client_ip"])
+}
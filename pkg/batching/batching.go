@@ -1,42 +1,269 @@
 package batching
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	syslog "github.com/wolfeidau/go-syslog"
+	"github.com/wolfeidau/go-syslog/format"
 )
 
+// limits of a single cloudwatch logs PutLogEvents request, the size of a batch is the sum of the
+// size of each event's message plus an overhead for each event, which also counts towards the size of an event
+const (
+	MaxBatchSize   = 1048576
+	MaxEventSize   = 262144
+	EventOverhead  = 26
+	MaxBatchEvents = 10000
+	MaxBatchSpan   = 24 * time.Hour
+	// events must be no older than this and no further in the future than MaxEventFuture
+	MaxEventAge    = 14 * 24 * time.Hour
+	MaxEventFuture = 2 * time.Hour
+)
+
+// ErrSaturated returned when entries aren't accepted by the batcher in time
+var ErrSaturated = errors.New("batcher is saturated")
+
 // DispatchFunc invoked when a batch is ready to send
 type DispatchFunc func([]*LogEntry)
 
+// AckFunc invoked once a log entry has been dispatched, err is nil if it was delivered
+type AckFunc func(err error)
+
+// RetriableError implemented by ack errors which know whether dispatching the entry again could deliver it
+type RetriableError interface {
+	error
+	Retriable() bool
+}
+
+// IsRetriable returns true if an entry acknowledged with the error could be delivered by dispatching it again,
+// errors which don't implement RetriableError, including wrapped errors, are assumed to be retriable
+func IsRetriable(err error) bool {
+	var re RetriableError
+	if errors.As(err, &re) {
+		return re.Retriable()
+	}
+
+	return true
+}
+
 // LogEntry decoded log entry
 type LogEntry struct {
 	Message        string
 	Parts          map[string]interface{}
 	MilliTimestamp int64
+	Received       time.Time
+	Ack            AckFunc
+	encoded        []byte
+}
+
+// NewLogEntry build a log entry from the parts of a parsed log message
+func NewLogEntry(logParts format.LogParts) *LogEntry {
+	content, ok := logParts["content"].(string)
+
+	if !ok {
+		logrus.WithField("content", logParts["content"]).Warn("missing field in logParts")
+	}
+
+	received := time.Now()
+
+	timestamp, ok := logParts["timestamp"].(time.Time)
+
+	if !ok {
+		logrus.WithField("timestamp", logParts["timestamp"]).Warn("missing field in logParts")
+		timestamp = received
+	}
+
+	return &LogEntry{
+		Message:        content,
+		Parts:          logParts,
+		MilliTimestamp: MilliTimestamp(timestamp),
+		Received:       received,
+	}
+}
+
+// DecodeLogEntry build a log entry from its JSON encoding, such as one read back from disk, numbers are
+// decoded as json.Number so the parts encode as they did originally
+func DecodeLogEntry(data []byte, milliTimestamp int64, received time.Time) (*LogEntry, error) {
+	parts := map[string]interface{}{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&parts)
+	if err != nil {
+		return nil, err
+	}
+
+	content, _ := parts["content"].(string)
+
+	return &LogEntry{
+		Message:        content,
+		Parts:          parts,
+		MilliTimestamp: milliTimestamp,
+		Received:       received,
+		encoded:        append([]byte(nil), data...),
+	}, nil
+}
+
+// Encoded returns the JSON encoding of the parts which is uploaded as the event's message, the encoding
+// is cached so the parts must not be changed once the entry has been added to a batch
+func (e *LogEntry) Encoded() ([]byte, error) {
+	if e.encoded != nil {
+		return e.encoded, nil
+	}
+
+	data, err := json.Marshal(e.Parts)
+	if err != nil {
+		return nil, err
+	}
+
+	e.encoded = data
+
+	return data, nil
+}
+
+// Reset discard the cached encoding after the parts have been changed
+func (e *LogEntry) Reset() {
+	e.encoded = nil
+}
+
+// EventSize returns the size of the entry counted towards the size of a batch
+func (e *LogEntry) EventSize() (int, error) {
+	data, err := e.Encoded()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(data) + EventOverhead, nil
+}
+
+// AckEntries invoke the ack function of each entry which has one
+func AckEntries(entries []*LogEntry, err error) {
+	for _, entry := range entries {
+		if entry.Ack != nil {
+			entry.Ack(err)
+		}
+	}
+}
+
+// JoinAck returns an ack function which invokes ack once it has been called count times, with the
+// first error it was called with, this is used when an entry is uploaded as more than one event
+func JoinAck(count int, ack AckFunc) AckFunc {
+	if ack == nil {
+		return nil
+	}
+
+	var (
+		lock  sync.Mutex
+		first error
+	)
+
+	return func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		if err != nil && first == nil {
+			first = err
+		}
+
+		count--
+
+		if count == 0 {
+			ack(first)
+		}
+	}
+}
+
+// Chunk split the entries, preserving their order, into batches within the limits of a single PutLogEvents request
+func Chunk(entries []*LogEntry) [][]*LogEntry {
+	chunks := [][]*LogEntry{}
+
+	var (
+		chunk          []*LogEntry
+		size           int
+		oldest, newest int64
+	)
+
+	for _, entry := range entries {
+		// entries which can't be encoded are dropped by the batcher
+		entrySize, _ := entry.EventSize()
+
+		if len(chunk) > 0 && (size+entrySize > MaxBatchSize || len(chunk) >= MaxBatchEvents || exceedsSpan(oldest, newest, entry.MilliTimestamp)) {
+			chunks = append(chunks, chunk)
+			chunk, size = nil, 0
+		}
+
+		if len(chunk) == 0 || entry.MilliTimestamp < oldest {
+			oldest = entry.MilliTimestamp
+		}
+		if len(chunk) == 0 || entry.MilliTimestamp > newest {
+			newest = entry.MilliTimestamp
+		}
+
+		chunk = append(chunk, entry)
+		size += entrySize
+	}
+
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
 }
 
-// Batcher builds lists of records for dispatch
+// Batcher builds lists of records for dispatch, each batch is within the limits of a single PutLogEvents request
 type Batcher struct {
 	dispatchFunc DispatchFunc
+	entries      chan []*LogEntry
 	records      []*LogEntry
 	flushTimer   *time.Timer
 	size         int
 	capacity     int
 	duration     time.Duration
+	oldest       int64
+	newest       int64
 }
 
-// NewBatcher configure a new batcher and it's dipsatch function
+// NewBatcher configure a new batcher and it's dipsatch function, capacity is the size in bytes
+// of the encoded events in a batch which can't exceed MaxBatchSize
 func NewBatcher(capacity int, duration time.Duration, dispatchFunc DispatchFunc) *Batcher {
+	if capacity <= 0 || capacity > MaxBatchSize {
+		capacity = MaxBatchSize
+	}
+
 	return &Batcher{
 		dispatchFunc: dispatchFunc,
+		entries:      make(chan []*LogEntry),
 		records:      []*LogEntry{},
 		capacity:     capacity,
 		duration:     duration,
 	}
 }
 
+// Submit add entries to the batch, this blocks until the batcher has accepted them
+func (b *Batcher) Submit(entries ...*LogEntry) {
+	b.entries <- entries
+}
+
+// SubmitTimeout add entries to the batch, returning ErrSaturated if the batcher doesn't accept
+// them within the timeout, for example while it is blocked dispatching a batch
+func (b *Batcher) SubmitTimeout(timeout time.Duration, entries ...*LogEntry) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case b.entries <- entries:
+		return nil
+	case <-timer.C:
+		return ErrSaturated
+	}
+}
+
 // Handler handle incoming log messages and write batches to the dispatcher function
 func (b *Batcher) Handler(channel syslog.LogPartsChannel) {
 	logrus.Info("handle ready")
@@ -47,31 +274,16 @@ func (b *Batcher) Handler(channel syslog.LogPartsChannel) {
 		select {
 		case logParts := <-channel:
 
-			content, ok := logParts["content"].(string)
-
-			if !ok {
-				logrus.WithField("content", logParts["content"]).Warn("missing field in logParts")
-			}
-
 			logrus.WithField("logParts", logParts).Debug("received message")
 
-			entry := &LogEntry{
-				Message:        content,
-				Parts:          logParts,
-				MilliTimestamp: makeMilliTimestamp(logParts["timestamp"].(time.Time)),
-			}
+			b.add(NewLogEntry(logParts))
 
-			if b.willOverflow(len(entry.Message)) {
-				logrus.Debugf("Batch flushed to prevent size overflow - size: %d, capacity: %v", b.size, b.capacity)
-				b.flush()
-			}
+		case entries := <-b.entries:
 
-			b.records = append(b.records, entry)
-			b.size += len(entry.Message)
+			for _, entry := range entries {
+				logrus.WithField("logParts", entry.Parts).Debug("received entry")
 
-			if b.isFullSize() {
-				logrus.Debugf("Batch flushed due to batch size - size: %d, capacity: %v", b.size, b.capacity)
-				b.flush()
+				b.add(entry)
 			}
 
 		case <-b.flushTimer.C:
@@ -87,12 +299,67 @@ func (b *Batcher) Length() int {
 	return len(b.records)
 }
 
+func (b *Batcher) add(entry *LogEntry) {
+	size, err := entry.EventSize()
+	if err != nil {
+		logrus.WithError(err).WithField("logParts", entry.Parts).Error("unable to marshal log entry into json")
+		AckEntries([]*LogEntry{entry}, err)
+		return
+	}
+
+	if b.willOverflow(size) {
+		logrus.Debugf("Batch flushed to prevent size overflow - size: %d, capacity: %v", b.size, b.capacity)
+		b.flush()
+	}
+
+	if b.willExceedSpan(entry.MilliTimestamp) {
+		logrus.Debugf("Batch flushed to prevent span overflow - events: %d", len(b.records))
+		b.flush()
+	}
+
+	if len(b.records) == 0 || entry.MilliTimestamp < b.oldest {
+		b.oldest = entry.MilliTimestamp
+	}
+	if len(b.records) == 0 || entry.MilliTimestamp > b.newest {
+		b.newest = entry.MilliTimestamp
+	}
+
+	b.records = append(b.records, entry)
+	b.size += size
+
+	if b.isFullSize() {
+		logrus.Debugf("Batch flushed due to batch size - size: %d, capacity: %v, events: %d", b.size, b.capacity, len(b.records))
+		b.flush()
+	}
+}
+
 func (b *Batcher) willOverflow(size int) bool {
 	return b.size+size > b.capacity
 }
 
+// willExceedSpan returns true if adding an event with the timestamp would make the batch span 24 hours or more
+func (b *Batcher) willExceedSpan(timestamp int64) bool {
+	if len(b.records) == 0 {
+		return false
+	}
+
+	return exceedsSpan(b.oldest, b.newest, timestamp)
+}
+
+// exceedsSpan returns true if a batch spanning oldest to newest would span 24 hours or more with the timestamp
+func exceedsSpan(oldest, newest, timestamp int64) bool {
+	if timestamp < oldest {
+		oldest = timestamp
+	}
+	if timestamp > newest {
+		newest = timestamp
+	}
+
+	return newest-oldest >= int64(MaxBatchSpan/time.Millisecond)
+}
+
 func (b *Batcher) isFullSize() bool {
-	return b.size >= b.capacity
+	return b.size >= b.capacity || len(b.records) >= MaxBatchEvents
 }
 
 func (b *Batcher) flush() {
@@ -107,6 +374,7 @@ func (b *Batcher) flush() {
 	}
 }
 
-func makeMilliTimestamp(input time.Time) int64 {
+// MilliTimestamp returns the time as milliseconds since the epoch, as used for event timestamps
+func MilliTimestamp(input time.Time) int64 {
 	return input.UTC().UnixNano() / int64(time.Millisecond)
 }
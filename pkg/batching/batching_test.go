@@ -1,6 +1,7 @@
 package batching
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -13,7 +14,7 @@ import (
 func Test_WhenNotFull(t *testing.T) {
 	channel := make(syslog.LogPartsChannel)
 	recordsChan := make(chan []*LogEntry, 1)
-	batcher := NewBatcher(100, 1*time.Second, dispatch(recordsChan))
+	batcher := NewBatcher(1000, 1*time.Second, dispatch(recordsChan))
 
 	go batcher.Handler(channel)
 
@@ -44,22 +45,32 @@ func Test_WhenFull(t *testing.T) {
 }
 
 func Test_WhenOverflow(t *testing.T) {
-	channel := make(syslog.LogPartsChannel)
-	recordsChan := make(chan []*LogEntry, 1)
-	batcher := NewBatcher(10, 1*time.Second, dispatch(recordsChan))
-
-	go batcher.Handler(channel)
+	now := time.Now()
 
-	channel <- format.LogParts{
+	first := format.LogParts{
 		"content":   "test123",
-		"timestamp": time.Now(),
+		"timestamp": now,
 	}
-
-	channel <- format.LogParts{
+	second := format.LogParts{
 		"content":   "test12333",
-		"timestamp": time.Now(),
+		"timestamp": now,
 	}
 
+	// the batch is measured using the encoded events rather than the content
+	firstSize, err := NewLogEntry(first).EventSize()
+	require.Nil(t, err)
+	secondSize, err := NewLogEntry(second).EventSize()
+	require.Nil(t, err)
+
+	channel := make(syslog.LogPartsChannel)
+	recordsChan := make(chan []*LogEntry, 1)
+	batcher := NewBatcher(firstSize+secondSize-1, 1*time.Second, dispatch(recordsChan))
+
+	go batcher.Handler(channel)
+
+	channel <- first
+	channel <- second
+
 	records := <-recordsChan
 
 	require.Equal(t, 1, batcher.Length())
@@ -89,3 +100,197 @@ func dispatch(records chan []*LogEntry) func([]*LogEntry) {
 		records <- entries
 	}
 }
+
+func Test_WhenSubmit(t *testing.T) {
+	channel := make(syslog.LogPartsChannel)
+	recordsChan := make(chan []*LogEntry, 1)
+	batcher := NewBatcher(1, 1*time.Second, dispatch(recordsChan))
+
+	go batcher.Handler(channel)
+
+	batcher.Submit(NewLogEntry(format.LogParts{
+		"content":   "test123",
+		"timestamp": time.Now(),
+	}))
+
+	records := <-recordsChan
+
+	require.Len(t, records, 1)
+	require.Equal(t, "test123", records[0].Message)
+}
+
+func Test_WhenSubmitTimeout(t *testing.T) {
+	recordsChan := make(chan []*LogEntry)
+	batcher := NewBatcher(1, 1*time.Second, dispatch(recordsChan))
+
+	go batcher.Handler(make(syslog.LogPartsChannel))
+
+	entry := &LogEntry{Message: "test123"}
+
+	err := batcher.SubmitTimeout(time.Second, entry)
+	require.Nil(t, err)
+
+	// the handler is blocked dispatching the first entry
+	err = batcher.SubmitTimeout(10*time.Millisecond, entry)
+	require.Equal(t, ErrSaturated, err)
+
+	records := <-recordsChan
+	require.Len(t, records, 1)
+}
+
+func Test_WhenAckEntries(t *testing.T) {
+	acked := []error{}
+	ack := func(err error) { acked = append(acked, err) }
+
+	AckEntries([]*LogEntry{{Ack: ack}, {}, {Ack: ack}}, nil)
+
+	require.Equal(t, []error{nil, nil}, acked)
+}
+
+func Test_WhenEventSize(t *testing.T) {
+	entry := &LogEntry{Parts: format.LogParts{"content": "test123"}}
+
+	size, err := entry.EventSize()
+	require.Nil(t, err)
+	require.Equal(t, len(`{"content":"test123"}`)+EventOverhead, size)
+
+	// the encoding is cached until reset
+	entry.Parts["content"] = "test123456"
+
+	data, err := entry.Encoded()
+	require.Nil(t, err)
+	require.Equal(t, `{"content":"test123"}`, string(data))
+
+	entry.Reset()
+
+	data, err = entry.Encoded()
+	require.Nil(t, err)
+	require.Equal(t, `{"content":"test123456"}`, string(data))
+}
+
+func Test_WhenDecodeLogEntry(t *testing.T) {
+	received := time.Now()
+
+	entry, err := DecodeLogEntry([]byte(`{"content":"test123","size":12345678901234567890}`), 1234, received)
+	require.Nil(t, err)
+	require.Equal(t, "test123", entry.Message)
+	require.Equal(t, int64(1234), entry.MilliTimestamp)
+	require.Equal(t, received, entry.Received)
+
+	entry.Reset()
+
+	data, err := entry.Encoded()
+	require.Nil(t, err)
+	require.Equal(t, `{"content":"test123","size":12345678901234567890}`, string(data))
+
+	_, err = DecodeLogEntry([]byte(`{"content"`), 1234, received)
+	require.NotNil(t, err)
+}
+
+func Test_WhenCapacityExceedsMaxBatchSize(t *testing.T) {
+	batcher := NewBatcher(2*MaxBatchSize, time.Second, dispatch(make(chan []*LogEntry)))
+	require.Equal(t, MaxBatchSize, batcher.capacity)
+
+	batcher = NewBatcher(0, time.Second, dispatch(make(chan []*LogEntry)))
+	require.Equal(t, MaxBatchSize, batcher.capacity)
+}
+
+func Test_WhenMaxBatchEvents(t *testing.T) {
+	recordsChan := make(chan []*LogEntry, 2)
+	batcher := NewBatcher(MaxBatchSize, time.Minute, dispatch(recordsChan))
+
+	go batcher.Handler(make(syslog.LogPartsChannel))
+
+	entries := make([]*LogEntry, MaxBatchEvents+1)
+	for n := range entries {
+		entries[n] = &LogEntry{Parts: format.LogParts{"content": "a"}}
+	}
+
+	batcher.Submit(entries...)
+
+	records := <-recordsChan
+	require.Len(t, records, MaxBatchEvents)
+}
+
+func Test_WhenMaxBatchSpan(t *testing.T) {
+	recordsChan := make(chan []*LogEntry, 2)
+	batcher := NewBatcher(MaxBatchSize, time.Minute, dispatch(recordsChan))
+
+	go batcher.Handler(make(syslog.LogPartsChannel))
+
+	now := time.Now()
+
+	batcher.Submit(
+		NewLogEntry(format.LogParts{"content": "a", "timestamp": now}),
+		NewLogEntry(format.LogParts{"content": "b", "timestamp": now.Add(-23 * time.Hour)}),
+		NewLogEntry(format.LogParts{"content": "c", "timestamp": now.Add(time.Hour)}),
+	)
+
+	records := <-recordsChan
+	require.Len(t, records, 2)
+	require.Equal(t, "a", records[0].Message)
+	require.Equal(t, "b", records[1].Message)
+}
+
+func Test_WhenEntryCantBeEncoded(t *testing.T) {
+	recordsChan := make(chan []*LogEntry, 1)
+	batcher := NewBatcher(1, time.Second, dispatch(recordsChan))
+
+	go batcher.Handler(make(syslog.LogPartsChannel))
+
+	acked := make(chan error, 1)
+
+	batcher.Submit(
+		&LogEntry{Parts: format.LogParts{"content": make(chan int)}, Ack: func(err error) { acked <- err }},
+		&LogEntry{Parts: format.LogParts{"content": "a"}},
+	)
+
+	require.Error(t, <-acked)
+
+	records := <-recordsChan
+	require.Len(t, records, 1)
+}
+
+func Test_WhenJoinAck(t *testing.T) {
+	acked := []error{}
+
+	ack := JoinAck(3, func(err error) { acked = append(acked, err) })
+
+	ack(nil)
+	ack(ErrSaturated)
+	require.Empty(t, acked)
+
+	ack(nil)
+	require.Equal(t, []error{ErrSaturated}, acked)
+
+	require.Nil(t, JoinAck(3, nil))
+}
+
+func Test_WhenChunk(t *testing.T) {
+	now := time.Now()
+
+	entries := []*LogEntry{}
+	for n := 0; n < MaxBatchEvents+10; n++ {
+		entries = append(entries, NewLogEntry(format.LogParts{"content": "a", "timestamp": now}))
+	}
+
+	chunks := Chunk(entries)
+	require.Len(t, chunks, 2)
+	require.Len(t, chunks[0], MaxBatchEvents)
+	require.Len(t, chunks[1], 10)
+
+	large := strings.Repeat("a", 400000)
+
+	chunks = Chunk([]*LogEntry{
+		NewLogEntry(format.LogParts{"content": large, "timestamp": now}),
+		NewLogEntry(format.LogParts{"content": large, "timestamp": now}),
+		NewLogEntry(format.LogParts{"content": large, "timestamp": now}),
+		NewLogEntry(format.LogParts{"content": "a", "timestamp": now.Add(-25 * time.Hour)}),
+	})
+	require.Len(t, chunks, 3)
+	require.Len(t, chunks[0], 2)
+	require.Len(t, chunks[1], 1)
+	require.Len(t, chunks[2], 1)
+
+	require.Empty(t, Chunk(nil))
+}
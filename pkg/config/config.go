@@ -3,7 +3,14 @@ package config
 import (
 	"crypto/tls"
 	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/kelseyhightower/envconfig"
 	"github.com/pkg/errors"
 	validator "gopkg.in/validator.v2"
 )
@@ -12,42 +19,531 @@ import (
 type SyslogConfig struct {
 	Debug        bool
 	Proxy        bool
-	Port         int `validate:"nonzero"`
+	Port         int
+	Framing      string `default:"auto" validate:"regexp=^(auto|octet-counting|lf|nul)?$"`
+	MaxFrameSize int    `default:"65536" validate:"max=65536"`
 	Region       string
 	Profile      string
 	Group        string `validate:"nonzero"`
 	Stream       string `validate:"nonzero"`
-	ClientCaCert string `validate:"nonzero"`
-	Cert         string `validate:"nonzero"`
-	Key          string `validate:"nonzero"`
+	ClientCaCert string
+	Cert         string
+	Key          string
+	PeerName     string `validate:"regexp=^(cn|san|ou)?$"`
+	// whether clients must present a certificate, and the peer name used when they don't
+	ClientAuth    string `default:"require" validate:"regexp=^(none|optional|require)?$"`
+	AnonymousPeer string `default:"anonymous"`
+	// paths to PEM files used instead of the base64 encoded values
+	ClientCaCertFile string
+	CertFile         string
+	KeyFile          string
+	// client certificate allow, deny and revocation lists
+	AllowClients   []string
+	DenyClients    []string
+	ClientCRLs     []string
+	ClientCRLFiles []string
+	CRLRefresh     time.Duration `default:"5m"`
+	CertRefresh    time.Duration
+	// TLS protocol settings
+	TLSMinVersion   string `default:"1.2"`
+	TLSMaxVersion   string
+	TLSCipherSuites []string
+	TLSCurves       []string
+	// UDP listener
+	UDPPort int
+	UDPBind string
+	// plain text TCP listener intended for trusted internal networks
+	TCPPort        int
+	TCPBind        string
+	TCPProxy       bool
+	TCPAllowPublic bool
+	// networks in CIDR notation, or addresses, which clients may or may not connect from
+	AllowSources []string
+	DenySources  []string
+	// connections accepted by each listener and from each source address, zero is unlimited, how long TLS
+	// handshakes and reads from idle connections may take, and the messages per second allowed on each connection
+	MaxConnections       int           `validate:"min=0"`
+	MaxSourceConnections int           `validate:"min=0"`
+	HandshakeTimeout     time.Duration `default:"10s" validate:"min=0"`
+	IdleTimeout          time.Duration `validate:"min=0"`
+	MaxMessageRate       int           `validate:"min=0"`
+	// names of additional listeners, each configured using the prefix LISTENER_<NAME>_
+	Listeners []string
+	// port serving expvar metrics on /debug/vars
+	MetricsPort int
+	// routes from TLS peer name to a destination in the form peer:group:stream
+	Routes []string
+	// routes from the VPC endpoint ID sent by NLB in the proxy protocol header in the form endpoint:group:stream,
+	// used when no peer route matches
+	EndpointRoutes []string
+	// how events larger than cloudwatch accepts are handled, one of truncate, split or deadletter, overridden
+	// for destinations in the form group:stream:policy
+	OversizePolicy   string `default:"truncate" validate:"regexp=^(truncate|split|deadletter)?$"`
+	OversizePolicies []string
+	// how events with timestamps cloudwatch doesn't accept are handled, either clamp to the time they
+	// were received, keeping the original in the original_timestamp field, or drop
+	TimestampPolicy string `default:"clamp" validate:"regexp=^(clamp|drop)?$"`
+	// file which events that can't be uploaded are appended to as JSON lines, defaults to deadletter.log in
+	// SpoolDir when spooling and is otherwise required so failed events aren't lost
+	DeadLetterFile string
+	// how long uploads which fail with throttling, server or network errors are retried, waiting with exponential
+	// backoff between the base and max delay, before the events are dead lettered
+	RetryTimeout   time.Duration `default:"5m" validate:"min=0"`
+	RetryBaseDelay time.Duration `default:"200ms" validate:"min=0"`
+	RetryMaxDelay  time.Duration `default:"30s" validate:"min=0"`
+	// directory batches are written to before upload so they survive outages and restarts, segment files are
+	// rotated once they reach SpoolSegmentSize and writes wait while the spool holds SpoolMaxSize bytes
+	SpoolDir         string
+	SpoolSegmentSize int64 `default:"16777216" validate:"min=0"`
+	SpoolMaxSize     int64 `default:"1073741824" validate:"min=0"`
+	// when spooled batches are synced to disk, one of always, interval or none
+	SpoolSync         string        `default:"always" validate:"regexp=^(always|interval|none)?$"`
+	SpoolSyncInterval time.Duration `default:"1s" validate:"min=0"`
+
+	named []*ListenerConfig
+}
+
+// networks which are not routable from the internet
+var privateNetworks = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// Process populate the configuration, including any named listeners, from the environment
+func (sc *SyslogConfig) Process(prefix string) error {
+	err := envconfig.Process(prefix, sc)
+	if err != nil {
+		return err
+	}
+
+	sc.named = make([]*ListenerConfig, len(sc.Listeners))
+
+	for n, name := range sc.Listeners {
+		lc := &ListenerConfig{Name: name}
+
+		err = envconfig.Process(fmt.Sprintf("%s_listener_%s", prefix, name), lc)
+		if err != nil {
+			return errors.Wrapf(err, "failed to process listener %s", name)
+		}
+
+		sc.named[n] = lc
+	}
+
+	return nil
 }
 
 // Validate validate the configuration
 func (sc *SyslogConfig) Validate() error {
-	return validator.Validate(sc)
-}
+	err := validator.Validate(sc)
+	if err != nil {
+		return err
+	}
 
-// Certificate decode and return the certificate
-func (sc *SyslogConfig) Certificate() (tls.Certificate, error) {
-	certPEMBlock, err := base64.StdEncoding.DecodeString(sc.Cert)
+	listeners := sc.ListenerConfigs()
+	if len(listeners) == 0 {
+		return errors.New("no listeners configured, set Port or Listeners")
+	}
+
+	names := map[string]bool{}
+
+	for _, lc := range listeners {
+		if names[lc.Name] {
+			return fmt.Errorf("listener %s is configured more than once", lc.Name)
+		}
+		names[lc.Name] = true
+
+		err = lc.Validate()
+		if err != nil {
+			return errors.Wrapf(err, "listener %s is invalid", lc.Name)
+		}
+	}
+
+	_, err = sc.PeerRoutes()
 	if err != nil {
-		return tls.Certificate{}, errors.Wrap(err, "failed to decode certificate data from config")
+		return err
 	}
 
-	keyPEMBlock, err := base64.StdEncoding.DecodeString(sc.Key)
+	_, err = sc.VPCEndpointRoutes()
 	if err != nil {
-		return tls.Certificate{}, errors.Wrap(err, "failed to decode key data from config")
+		return err
 	}
 
-	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+	_, err = sc.DestinationOversizePolicies()
+	if err != nil {
+		return err
+	}
+
+	if sc.DeadLetterPath() == "" {
+		return errors.New("DeadLetterFile is required unless SpoolDir is set, events which can't be uploaded are written to it")
+	}
+
+	if sc.SpoolDir != "" && sc.SpoolMaxSize < 2*sc.SpoolSegmentSize {
+		return errors.New("SpoolMaxSize must be at least twice SpoolSegmentSize")
+	}
+
+	return nil
+}
+
+// DeadLetterPath returns the file events which can't be uploaded are appended to, DeadLetterFile
+// or deadletter.log in the spool directory
+func (sc *SyslogConfig) DeadLetterPath() string {
+	if sc.DeadLetterFile != "" || sc.SpoolDir == "" {
+		return sc.DeadLetterFile
+	}
+
+	return filepath.Join(sc.SpoolDir, "deadletter.log")
+}
+
+// supported ways of handling events larger than cloudwatch accepts
+const (
+	OversizeTruncate   = "truncate"
+	OversizeSplit      = "split"
+	OversizeDeadLetter = "deadletter"
+)
+
+// supported ways of handling events with timestamps outside the range cloudwatch accepts
+const (
+	TimestampClamp = "clamp"
+	TimestampDrop  = "drop"
+)
+
+// supported policies for syncing spooled batches to disk
+const (
+	SyncAlways   = "always"
+	SyncInterval = "interval"
+	SyncNone     = "none"
+)
+
+// Route cloudwatch log group and stream which messages are uploaded to
+type Route struct {
+	Group  string
+	Stream string
+}
+
+// DefaultRoute returns the route used for messages which don't match any other route
+func (sc *SyslogConfig) DefaultRoute() Route {
+	return Route{Group: sc.Group, Stream: sc.Stream}
 }
 
-// ClientCaCertificate decode and return the ca certificate
+// PeerRoutes parse and return the routes keyed by TLS peer name
+func (sc *SyslogConfig) PeerRoutes() (map[string]Route, error) {
+	return parseRoutes("peer", sc.Routes)
+}
+
+// VPCEndpointRoutes parse and return the routes keyed by VPC endpoint ID
+func (sc *SyslogConfig) VPCEndpointRoutes() (map[string]Route, error) {
+	return parseRoutes("endpoint", sc.EndpointRoutes)
+}
+
+// DestinationOversizePolicies parse and return the oversize policies which override the default for each destination
+func (sc *SyslogConfig) DestinationOversizePolicies() (map[Route]string, error) {
+	policies := map[Route]string{}
+
+	for _, value := range sc.OversizePolicies {
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("oversize policy %q must be in the form group:stream:policy", value)
+		}
+
+		switch parts[2] {
+		case OversizeTruncate, OversizeSplit, OversizeDeadLetter:
+		default:
+			return nil, fmt.Errorf("oversize policy %q must be one of truncate, split or deadletter", value)
+		}
+
+		policies[Route{Group: parts[0], Stream: parts[1]}] = parts[2]
+	}
+
+	return policies, nil
+}
+
+func parseRoutes(kind string, values []string) (map[string]Route, error) {
+	routes := map[string]Route{}
+
+	for _, value := range values {
+		// neither log group or stream names may contain a colon
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("route %q must be in the form %s:group:stream", value, kind)
+		}
+
+		routes[parts[0]] = Route{Group: parts[1], Stream: parts[2]}
+	}
+
+	return routes, nil
+}
+
+// ListenerConfigs returns the listeners configured using the top level settings followed by the named listeners
+func (sc *SyslogConfig) ListenerConfigs() []*ListenerConfig {
+	listeners := []*ListenerConfig{}
+
+	if sc.Port != 0 {
+		listeners = append(listeners, &ListenerConfig{
+			Name:             TransportTLS,
+			Transport:        TransportTLS,
+			Port:             sc.Port,
+			Framing:          sc.Framing,
+			MaxFrameSize:     sc.MaxFrameSize,
+			Proxy:            sc.Proxy,
+			ClientCaCert:     sc.ClientCaCert,
+			Cert:             sc.Cert,
+			Key:              sc.Key,
+			PeerName:         sc.PeerName,
+			ClientAuth:       sc.ClientAuth,
+			AnonymousPeer:    sc.AnonymousPeer,
+			ClientCaCertFile: sc.ClientCaCertFile,
+			CertFile:         sc.CertFile,
+			KeyFile:          sc.KeyFile,
+			AllowClients:     sc.AllowClients,
+			DenyClients:      sc.DenyClients,
+			ClientCRLs:       sc.ClientCRLs,
+			ClientCRLFiles:   sc.ClientCRLFiles,
+			CRLRefresh:       sc.CRLRefresh,
+			CertRefresh:      sc.CertRefresh,
+			TLSMinVersion:    sc.TLSMinVersion,
+			TLSMaxVersion:    sc.TLSMaxVersion,
+			TLSCipherSuites:  sc.TLSCipherSuites,
+			TLSCurves:        sc.TLSCurves,
+			AllowSources:     sc.AllowSources,
+			DenySources:      sc.DenySources,
+			ConnectionLimits: sc.connectionLimits(),
+		})
+	}
+
+	if sc.UDPPort != 0 {
+		listeners = append(listeners, &ListenerConfig{
+			Name:      TransportUDP,
+			Transport: TransportUDP,
+			Bind:      sc.UDPBind,
+			Port:      sc.UDPPort,
+		})
+	}
+
+	if sc.TCPPort != 0 {
+		listeners = append(listeners, &ListenerConfig{
+			Name:             TransportTCP,
+			Transport:        TransportTCP,
+			Bind:             sc.TCPBind,
+			Port:             sc.TCPPort,
+			Framing:          sc.Framing,
+			MaxFrameSize:     sc.MaxFrameSize,
+			Proxy:            sc.TCPProxy,
+			AllowPublic:      sc.TCPAllowPublic,
+			AllowSources:     sc.AllowSources,
+			DenySources:      sc.DenySources,
+			ConnectionLimits: sc.connectionLimits(),
+		})
+	}
+
+	for _, lc := range sc.named {
+		named := *lc
+
+		if named.Framing == "" {
+			named.Framing = sc.Framing
+		}
+		if named.MaxFrameSize == 0 {
+			named.MaxFrameSize = sc.MaxFrameSize
+		}
+
+		// TLS settings not supplied for a named listener are shared with the top level configuration
+		if named.ClientCaCert == "" && named.ClientCaCertFile == "" {
+			named.ClientCaCert = sc.ClientCaCert
+			named.ClientCaCertFile = sc.ClientCaCertFile
+		}
+		if named.Cert == "" && named.CertFile == "" {
+			named.Cert = sc.Cert
+			named.CertFile = sc.CertFile
+		}
+		if named.Key == "" && named.KeyFile == "" {
+			named.Key = sc.Key
+			named.KeyFile = sc.KeyFile
+		}
+		if named.PeerName == "" {
+			named.PeerName = sc.PeerName
+		}
+		if named.ClientAuth == "" {
+			named.ClientAuth = sc.ClientAuth
+		}
+		if named.AnonymousPeer == "" {
+			named.AnonymousPeer = sc.AnonymousPeer
+		}
+		if len(named.AllowClients) == 0 {
+			named.AllowClients = sc.AllowClients
+		}
+		if len(named.DenyClients) == 0 {
+			named.DenyClients = sc.DenyClients
+		}
+		if len(named.ClientCRLs) == 0 && len(named.ClientCRLFiles) == 0 {
+			named.ClientCRLs = sc.ClientCRLs
+			named.ClientCRLFiles = sc.ClientCRLFiles
+		}
+		if named.CertRefresh == 0 {
+			named.CertRefresh = sc.CertRefresh
+		}
+		if named.TLSMinVersion == "" {
+			named.TLSMinVersion = sc.TLSMinVersion
+		}
+		if named.TLSMaxVersion == "" {
+			named.TLSMaxVersion = sc.TLSMaxVersion
+		}
+		if len(named.TLSCipherSuites) == 0 {
+			named.TLSCipherSuites = sc.TLSCipherSuites
+		}
+		if len(named.TLSCurves) == 0 {
+			named.TLSCurves = sc.TLSCurves
+		}
+		if len(named.AllowSources) == 0 {
+			named.AllowSources = sc.AllowSources
+		}
+		if len(named.DenySources) == 0 {
+			named.DenySources = sc.DenySources
+		}
+		named.ConnectionLimits = named.ConnectionLimits.inherit(sc.connectionLimits())
+
+		listeners = append(listeners, &named)
+	}
+
+	return listeners
+}
+
+// IsPublicBind returns true if the bind address may accept connections from public networks
+func IsPublicBind(bind string) bool {
+	if bind == "localhost" {
+		return false
+	}
+
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		// an empty address or a hostname which we can't check
+		return true
+	}
+
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Certificate decode or read and return the certificate
+func (sc *SyslogConfig) Certificate() (tls.Certificate, error) {
+	return loadCertificate(sc.Cert, sc.CertFile, sc.Key, sc.KeyFile)
+}
+
+// ClientCaCertificate decode or read and return the ca certificates
 func (sc *SyslogConfig) ClientCaCertificate() ([]byte, error) {
-	certPEMBlock, err := base64.StdEncoding.DecodeString(sc.ClientCaCert)
+	return loadCaCertificate(sc.ClientCaCert, sc.ClientCaCertFile)
+}
+
+// loadCertificate the certificate, which may be a bundle including intermediates, and key
+func loadCertificate(cert, certFile, key, keyFile string) (tls.Certificate, error) {
+	var (
+		certPEMBlock, keyPEMBlock []byte
+		err                       error
+	)
+
+	if certFile != "" {
+		certPEMBlock, err = ioutil.ReadFile(certFile)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to read certificate file")
+		}
+	} else {
+		certPEMBlock, err = base64.StdEncoding.DecodeString(cert)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to decode certificate data from config")
+		}
+	}
+
+	if keyFile != "" {
+		keyPEMBlock, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to read key file")
+		}
+	} else {
+		keyPEMBlock, err = base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return tls.Certificate{}, errors.Wrap(err, "failed to decode key data from config")
+		}
+	}
+
+	return tls.X509KeyPair(certPEMBlock, keyPEMBlock)
+}
+
+// loadCaCertificate the ca certificate, which may be a bundle of a number of CAs
+func loadCaCertificate(caCert, caCertFile string) ([]byte, error) {
+	if caCertFile != "" {
+		certPEMBlock, err := ioutil.ReadFile(caCertFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read ca certificate file")
+		}
+
+		return certPEMBlock, nil
+	}
+
+	certPEMBlock, err := base64.StdEncoding.DecodeString(caCert)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to decode ca certificate data from config")
 	}
 
 	return certPEMBlock, nil
 }
+
+func (sc *SyslogConfig) connectionLimits() ConnectionLimits {
+	return ConnectionLimits{
+		MaxConnections:       sc.MaxConnections,
+		MaxSourceConnections: sc.MaxSourceConnections,
+		HandshakeTimeout:     sc.HandshakeTimeout,
+		IdleTimeout:          sc.IdleTimeout,
+		MaxMessageRate:       sc.MaxMessageRate,
+	}
+}
+
+// ParseNetworks parse networks in CIDR notation, addresses are treated as a network containing only that address
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, len(values))
+
+	for n, value := range values {
+		if ip := net.ParseIP(value); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+
+			networks[n] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "source %q must be an address or network in CIDR notation", value)
+		}
+
+		networks[n] = network
+	}
+
+	return networks, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(cidrs))
+
+	for n, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks[n] = network
+	}
+
+	return networks
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	validator "gopkg.in/validator.v2"
+)
+
+// supported listener transports
+const (
+	TransportTLS = "tls"
+	TransportTCP = "tcp"
+	TransportUDP = "udp"
+	// RELP over plain TCP or TLS
+	TransportRELP    = "relp"
+	TransportRELPTLS = "relp-tls"
+	// JSON posted over HTTP or HTTPS
+	TransportHTTP  = "http"
+	TransportHTTPS = "https"
+	// GELF JSON over TCP terminated by NUL, or UDP optionally compressed and chunked
+	TransportGELFTCP = "gelf-tcp"
+	TransportGELFUDP = "gelf-udp"
+	// fluentd forward protocol over plain TCP or TLS
+	TransportForward    = "forward"
+	TransportForwardTLS = "forward-tls"
+	// syslog over a UNIX stream or datagram socket
+	TransportUnix     = "unix"
+	TransportUnixgram = "unixgram"
+)
+
+// supported points at which RELP messages are acknowledged
+const (
+	AckModeAccepted  = "accepted"
+	AckModeDelivered = "delivered"
+)
+
+// supported listener framing
+const (
+	FramingAuto          = "auto"
+	FramingOctetCounting = "octet-counting"
+	FramingLF            = "lf"
+	FramingNUL           = "nul"
+)
+
+// supported attributes of the client certificate used to name the TLS peer
+const (
+	PeerNameCN  = "cn"
+	PeerNameSAN = "san"
+	PeerNameOU  = "ou"
+)
+
+// supported client certificate modes
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// supported kinds of client certificate match used in allow and deny lists
+const (
+	ClientMatchCN     = "cn"
+	ClientMatchURI    = "uri"
+	ClientMatchSHA256 = "sha256"
+)
+
+// ListenerConfig configuration for a single named listener
+type ListenerConfig struct {
+	Name         string `ignored:"true" validate:"regexp=^[A-Za-z0-9_]+$"`
+	Transport    string `default:"tls" validate:"regexp=^(tls|tcp|udp|relp|relp-tls|http|https|gelf-tcp|gelf-udp|forward|forward-tls|unix|unixgram)$"`
+	Bind         string
+	Port         int    `validate:"nonzero"`
+	Framing      string `validate:"regexp=^(auto|octet-counting|lf|nul)?$"`
+	MaxFrameSize int    `validate:"max=65536"`
+	Proxy        bool
+	AllowPublic  bool
+	// path of UNIX sockets, their octal permissions and the group, by name or ID, which owns them
+	Path         string
+	SocketMode   string `default:"0660" validate:"regexp=^([0-7]?[0-7][0-7][0-7])?$"`
+	SocketGroup  string
+	ClientCaCert string
+	Cert         string
+	Key          string
+	PeerName     string `validate:"regexp=^(cn|san|ou)?$"`
+	// whether clients must present a certificate, and the peer name used when they don't
+	ClientAuth    string `validate:"regexp=^(none|optional|require)?$"`
+	AnonymousPeer string
+	// paths to PEM files used instead of the base64 encoded values
+	ClientCaCertFile string
+	CertFile         string
+	KeyFile          string
+	// client certificates matches in the form kind:value, for example cn:apigee or sha256:<fingerprint>
+	AllowClients []string
+	DenyClients  []string
+	// certificate revocation lists as base64 encoded PEM or DER, or paths to files which are re-read periodically
+	ClientCRLs     []string
+	ClientCRLFiles []string
+	CRLRefresh     time.Duration `default:"5m"`
+	// interval to reload the certificate, key, client CA and revocation lists, these are also reloaded on SIGHUP
+	CertRefresh time.Duration
+	// TLS versions in the form 1.2, cipher suites using their IANA names and curves named X25519, P256, P384 or P521
+	TLSMinVersion   string
+	TLSMaxVersion   string
+	TLSCipherSuites []string
+	TLSCurves       []string
+	// networks in CIDR notation, or addresses, which clients may or may not connect from, checked against
+	// the address from the proxy protocol header when proxying
+	AllowSources []string
+	DenySources  []string
+	// limits on connections to stream listeners
+	ConnectionLimits
+	// acknowledge RELP messages and forward chunks once accepted by the batcher or once delivered to cloudwatch
+	AckMode string `default:"accepted" validate:"regexp=^(accepted|delivered)?$"`
+	// HTTP request body and forward message size limit, the field holding each HTTP entry's timestamp and
+	// how long HTTP requests wait for the batcher
+	MaxBodySize    int64         `default:"1048576"`
+	TimestampField string        `default:"timestamp"`
+	QueueTimeout   time.Duration `default:"1s"`
+}
+
+// ConnectionLimits connections accepted by the listener and from each source address, zero is unlimited, how long
+// TLS handshakes and reads from idle connections may take, and the messages per second allowed on each connection
+type ConnectionLimits struct {
+	MaxConnections       int           `validate:"min=0"`
+	MaxSourceConnections int           `validate:"min=0"`
+	HandshakeTimeout     time.Duration `validate:"min=0"`
+	IdleTimeout          time.Duration `validate:"min=0"`
+	MaxMessageRate       int           `validate:"min=0"`
+}
+
+// inherit returns the limits with any which aren't set taken from the defaults
+func (cl ConnectionLimits) inherit(defaults ConnectionLimits) ConnectionLimits {
+	if cl.MaxConnections == 0 {
+		cl.MaxConnections = defaults.MaxConnections
+	}
+	if cl.MaxSourceConnections == 0 {
+		cl.MaxSourceConnections = defaults.MaxSourceConnections
+	}
+	if cl.HandshakeTimeout == 0 {
+		cl.HandshakeTimeout = defaults.HandshakeTimeout
+	}
+	if cl.IdleTimeout == 0 {
+		cl.IdleTimeout = defaults.IdleTimeout
+	}
+	if cl.MaxMessageRate == 0 {
+		cl.MaxMessageRate = defaults.MaxMessageRate
+	}
+
+	return cl
+}
+
+// Validate validate the listener configuration
+func (lc *ListenerConfig) Validate() error {
+	err := validator.Validate(lc)
+
+	// UNIX sockets are bound to a path rather than a port
+	if errs, ok := err.(validator.ErrorMap); ok && lc.IsUnix() {
+		delete(errs, "Port")
+		if len(errs) == 0 {
+			err = nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if lc.IsUnix() && !filepath.IsAbs(lc.Path) {
+		return fmt.Errorf("%s listener path %q must be absolute", lc.Transport, lc.Path)
+	}
+
+	_, err = ParseNetworks(append(lc.AllowSources, lc.DenySources...))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case lc.IsTLS():
+		// a client CA isn't needed when client certificates aren't requested
+		if lc.ClientAuth != ClientAuthNone || lc.ClientCaCert != "" || lc.ClientCaCertFile != "" {
+			err = validatePEMSource("ClientCaCert", lc.ClientCaCert, lc.ClientCaCertFile)
+			if err != nil {
+				return err
+			}
+		}
+		err = validatePEMSource("Cert", lc.Cert, lc.CertFile)
+		if err != nil {
+			return err
+		}
+		err = validatePEMSource("Key", lc.Key, lc.KeyFile)
+		if err != nil {
+			return err
+		}
+		_, _, err = lc.TLSVersions()
+		if err != nil {
+			return err
+		}
+		_, err = lc.TLSCipherSuiteIDs()
+		if err != nil {
+			return err
+		}
+		_, err = lc.TLSCurveIDs()
+		if err != nil {
+			return err
+		}
+		for _, match := range append(lc.AllowClients, lc.DenyClients...) {
+			_, _, err = ParseClientMatch(match)
+			if err != nil {
+				return err
+			}
+		}
+		// clients which don't present a certificate would bypass the allow list
+		if len(lc.AllowClients) > 0 && (lc.ClientAuth == ClientAuthNone || lc.ClientAuth == ClientAuthOptional) {
+			return fmt.Errorf("%s listener AllowClients requires ClientAuth to be %s", lc.Transport, ClientAuthRequire)
+		}
+	case lc.IsPlainTextStream():
+		if !lc.AllowPublic && IsPublicBind(lc.Bind) {
+			return fmt.Errorf("plain text %s listener bind address %q is public, set AllowPublic to permit this", lc.Transport, lc.Bind)
+		}
+	}
+
+	return nil
+}
+
+// IsTLS returns true if the listener accepts TLS connections
+func (lc *ListenerConfig) IsTLS() bool {
+	switch lc.Transport {
+	case TransportTLS, TransportRELPTLS, TransportHTTPS, TransportForwardTLS:
+		return true
+	}
+
+	return false
+}
+
+// IsPlainTextStream returns true if the listener accepts connections which aren't encrypted
+func (lc *ListenerConfig) IsPlainTextStream() bool {
+	switch lc.Transport {
+	case TransportTCP, TransportRELP, TransportHTTP, TransportGELFTCP, TransportForward:
+		return true
+	}
+
+	return false
+}
+
+// IsUnix returns true if the listener is a UNIX socket
+func (lc *ListenerConfig) IsUnix() bool {
+	return lc.Transport == TransportUnix || lc.Transport == TransportUnixgram
+}
+
+// Addr returns the address the listener binds to, or the path of UNIX sockets
+func (lc *ListenerConfig) Addr() string {
+	if lc.IsUnix() {
+		return lc.Path
+	}
+
+	return net.JoinHostPort(lc.Bind, strconv.Itoa(lc.Port))
+}
+
+// FileMode returns the permissions of UNIX sockets
+func (lc *ListenerConfig) FileMode() (os.FileMode, error) {
+	if lc.SocketMode == "" {
+		return 0660, nil
+	}
+
+	mode, err := strconv.ParseUint(lc.SocketMode, 8, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "socket mode %q must be octal", lc.SocketMode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// Certificate decode or read and return the certificate
+func (lc *ListenerConfig) Certificate() (tls.Certificate, error) {
+	return loadCertificate(lc.Cert, lc.CertFile, lc.Key, lc.KeyFile)
+}
+
+// ClientCaCertificate decode or read and return the ca certificates
+func (lc *ListenerConfig) ClientCaCertificate() ([]byte, error) {
+	return loadCaCertificate(lc.ClientCaCert, lc.ClientCaCertFile)
+}
+
+// TLSClientAuth returns the client certificate mode, defaulting to requiring a verified certificate
+func (lc *ListenerConfig) TLSClientAuth() tls.ClientAuthType {
+	switch lc.ClientAuth {
+	case ClientAuthNone:
+		return tls.NoClientCert
+	case ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	}
+
+	return tls.RequireAndVerifyClientCert
+}
+
+// ClientRevocationLists decode and return the certificate revocation lists
+func (lc *ListenerConfig) ClientRevocationLists() ([][]byte, error) {
+	crls := make([][]byte, len(lc.ClientCRLs))
+
+	for n, crl := range lc.ClientCRLs {
+		data, err := base64.StdEncoding.DecodeString(crl)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode certificate revocation list from config")
+		}
+
+		crls[n] = data
+	}
+
+	return crls, nil
+}
+
+// ParseClientMatch parse a client certificate match in the form kind:value
+func ParseClientMatch(match string) (kind string, value string, err error) {
+	parts := strings.SplitN(match, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("client match %q must be in the form kind:value", match)
+	}
+
+	kind, value = parts[0], parts[1]
+
+	switch kind {
+	case ClientMatchCN, ClientMatchURI:
+		return kind, value, nil
+	case ClientMatchSHA256:
+		// fingerprints are often formatted with colons between each byte
+		return kind, strings.ToLower(strings.Replace(value, ":", "", -1)), nil
+	}
+
+	return "", "", fmt.Errorf("client match %q must use one of cn, uri or sha256", match)
+}
+
+// validatePEMSource check exactly one of the base64 encoded value or file is set, and the file exists
+func validatePEMSource(name, value, file string) error {
+	if (value == "") == (file == "") {
+		return fmt.Errorf("TLS listener requires exactly one of %s or %sFile", name, name)
+	}
+
+	if file != "" {
+		_, err := os.Stat(file)
+		if err != nil {
+			return errors.Wrapf(err, "TLS listener %sFile can't be read", name)
+		}
+	}
+
+	return nil
+}
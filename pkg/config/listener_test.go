@@ -0,0 +1,323 @@
+package config
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenListenerValidate(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:         "prod",
+		Transport:    TransportTLS,
+		Port:         10514,
+		ClientCaCert: "abc",
+		Cert:         "abc",
+		Key:          "abc",
+	}
+
+	err := lc.Validate()
+	require.Nil(t, err)
+
+	lc.Key = ""
+
+	err = lc.Validate()
+	require.Error(t, err, "TLS listener requires ClientCaCert, Cert and Key")
+}
+
+func Test_WhenListenerValidateRELP(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "relp",
+		Transport: TransportRELP,
+		Port:      2514,
+		AckMode:   AckModeDelivered,
+	}
+
+	err := lc.Validate()
+	require.Error(t, err, "plain text RELP must not bind to a public address")
+
+	lc.Bind = "127.0.0.1"
+
+	err = lc.Validate()
+	require.Nil(t, err)
+
+	lc.AckMode = "never"
+
+	err = lc.Validate()
+	require.Error(t, err)
+
+	lc.AckMode = AckModeAccepted
+	lc.Transport = TransportRELPTLS
+
+	err = lc.Validate()
+	require.Error(t, err, "RELP over TLS requires certificates")
+}
+
+func Test_WhenListenerValidateHTTP(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "api",
+		Transport: TransportHTTP,
+		Port:      8080,
+	}
+
+	require.False(t, lc.IsTLS())
+	require.Error(t, lc.Validate(), "plain text HTTP must not bind to a public address")
+
+	lc.AllowPublic = true
+	require.Nil(t, lc.Validate())
+
+	lc.Transport = TransportHTTPS
+	require.True(t, lc.IsTLS())
+	require.Error(t, lc.Validate(), "HTTPS requires certificates")
+}
+
+func Test_WhenListenerValidateGELF(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "docker",
+		Transport: TransportGELFTCP,
+		Port:      12201,
+	}
+
+	require.Error(t, lc.Validate(), "plain text GELF must not bind to a public address")
+
+	lc.Transport = TransportGELFUDP
+	require.Nil(t, lc.Validate())
+}
+
+func Test_WhenListenerValidateSources(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:         "syslog",
+		Transport:    TransportTCP,
+		Bind:         "10.1.2.3",
+		Port:         1514,
+		AllowSources: []string{"10.0.0.0/8"},
+		DenySources:  []string{"10.1.2.0/24", "10.2.3.4"},
+	}
+
+	require.Nil(t, lc.Validate())
+
+	lc.DenySources = []string{"10.1.2.0/40"}
+	require.Error(t, lc.Validate())
+}
+
+func Test_WhenListenerValidateForward(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "fluent",
+		Transport: TransportForward,
+		Bind:      "10.0.0.10",
+		Port:      24224,
+	}
+
+	require.False(t, lc.IsTLS())
+	require.Nil(t, lc.Validate())
+
+	lc.Transport = TransportForwardTLS
+	require.True(t, lc.IsTLS())
+	require.Error(t, lc.Validate(), "forward over TLS requires certificates")
+}
+
+func Test_WhenListenerValidateUnix(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "devlog",
+		Transport: TransportUnixgram,
+		Path:      "/var/run/syslog/log",
+	}
+
+	require.True(t, lc.IsUnix())
+	require.Nil(t, lc.Validate())
+	require.Equal(t, "/var/run/syslog/log", lc.Addr())
+
+	mode, err := lc.FileMode()
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0660), mode)
+
+	lc.SocketMode = "0666"
+	mode, err = lc.FileMode()
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0666), mode)
+
+	lc.SocketMode = "999"
+	require.Error(t, lc.Validate())
+
+	lc.SocketMode = ""
+	lc.Path = "log"
+	require.Error(t, lc.Validate(), "path must be absolute")
+
+	lc.Transport = TransportUnix
+	lc.Path = ""
+	require.Error(t, lc.Validate(), "path is required")
+}
+
+func Test_WhenListenerValidateFails(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:      "apigee-prod",
+		Transport: "sctp",
+		Framing:   "stx",
+	}
+
+	err := lc.Validate()
+	require.NotNil(t, err)
+
+	require.Contains(t, err.Error(), "Name")
+	require.Contains(t, err.Error(), "Transport")
+	require.Contains(t, err.Error(), "Port")
+	require.Contains(t, err.Error(), "Framing")
+}
+
+func Test_WhenParseClientMatch(t *testing.T) {
+	kind, value, err := ParseClientMatch("cn:apigee-prod")
+	require.Nil(t, err)
+	require.Equal(t, ClientMatchCN, kind)
+	require.Equal(t, "apigee-prod", value)
+
+	kind, value, err = ParseClientMatch("sha256:AB:CD:EF")
+	require.Nil(t, err)
+	require.Equal(t, ClientMatchSHA256, kind)
+	require.Equal(t, "abcdef", value)
+
+	_, _, err = ParseClientMatch("apigee-prod")
+	require.Error(t, err)
+
+	_, _, err = ParseClientMatch("ou:platform")
+	require.Error(t, err)
+}
+
+func Test_WhenListenerClientAuth(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:       "prod",
+		Transport:  TransportTLS,
+		Port:       10514,
+		Cert:       "abc",
+		Key:        "abc",
+		ClientAuth: ClientAuthNone,
+	}
+
+	err := lc.Validate()
+	require.Nil(t, err)
+	require.Equal(t, tls.NoClientCert, lc.TLSClientAuth())
+
+	lc.ClientAuth = ClientAuthOptional
+
+	err = lc.Validate()
+	require.EqualError(t, err, "TLS listener requires exactly one of ClientCaCert or ClientCaCertFile")
+	require.Equal(t, tls.VerifyClientCertIfGiven, lc.TLSClientAuth())
+
+	lc.ClientAuth = ""
+	require.Equal(t, tls.RequireAndVerifyClientCert, lc.TLSClientAuth())
+
+	// allow lists can't be enforced on clients which don't present a certificate
+	lc.ClientCaCert = "def"
+	lc.AllowClients = []string{"cn:apigee-prod"}
+
+	for _, clientAuth := range []string{ClientAuthNone, ClientAuthOptional} {
+		lc.ClientAuth = clientAuth
+
+		err = lc.Validate()
+		require.EqualError(t, err, "tls listener AllowClients requires ClientAuth to be require")
+	}
+
+	lc.ClientAuth = ClientAuthRequire
+
+	err = lc.Validate()
+	require.Nil(t, err)
+}
+
+func Test_WhenListenerValidatePEMSource(t *testing.T) {
+	lc := &ListenerConfig{
+		Name:             "prod",
+		Transport:        TransportTLS,
+		Port:             10514,
+		ClientCaCert:     "abc",
+		ClientCaCertFile: "/etc/syslog-cloudlogs/ca.pem",
+		Cert:             "abc",
+		Key:              "abc",
+	}
+
+	err := lc.Validate()
+	require.EqualError(t, err, "TLS listener requires exactly one of ClientCaCert or ClientCaCertFile")
+
+	lc.ClientCaCert = ""
+
+	err = lc.Validate()
+	require.Contains(t, err.Error(), "TLS listener ClientCaCertFile can't be read")
+
+	lc.ClientCaCertFile = ""
+
+	err = lc.Validate()
+	require.EqualError(t, err, "TLS listener requires exactly one of ClientCaCert or ClientCaCertFile")
+}
+
+func Test_WhenListenerCertificateFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caPEM, certPEM, keyPEM := newTestCertificates(t)
+
+	// server certificate bundled with an intermediate and a bundle of CAs
+	writeTestFile(t, dir, "server.pem", append(certPEM, caPEM...))
+	writeTestFile(t, dir, "server-key.pem", keyPEM)
+	writeTestFile(t, dir, "ca.pem", append(caPEM, caPEM...))
+
+	lc := &ListenerConfig{
+		Name:             "prod",
+		Transport:        TransportTLS,
+		Port:             10514,
+		ClientCaCertFile: filepath.Join(dir, "ca.pem"),
+		CertFile:         filepath.Join(dir, "server.pem"),
+		KeyFile:          filepath.Join(dir, "server-key.pem"),
+	}
+
+	err = lc.Validate()
+	require.Nil(t, err)
+
+	cert, err := lc.Certificate()
+	require.Nil(t, err)
+	require.Len(t, cert.Certificate, 2)
+
+	caCert, err := lc.ClientCaCertificate()
+	require.Nil(t, err)
+	require.Equal(t, append(caPEM, caPEM...), caCert)
+}
+
+func newTestCertificates(t *testing.T) (caPEM, certPEM, keyPEM []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.Nil(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	return certPEM, certPEM, keyPEM
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) {
+	err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600)
+	require.Nil(t, err)
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// TLSVersionName returns the name of the TLS version as used in the configuration
+func TLSVersionName(version uint16) string {
+	for name, v := range tlsVersions {
+		if v == version {
+			return name
+		}
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// TLSVersions parse and return the minimum and maximum TLS versions, zero indicates the default
+func (lc *ListenerConfig) TLSVersions() (min uint16, max uint16, err error) {
+	min, err = parseTLSVersion(lc.TLSMinVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	max, err = parseTLSVersion(lc.TLSMaxVersion)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if min != 0 && max != 0 && min > max {
+		return 0, 0, fmt.Errorf("TLS minimum version %s is greater than the maximum version %s", lc.TLSMinVersion, lc.TLSMaxVersion)
+	}
+
+	return min, max, nil
+}
+
+// TLSCipherSuiteIDs parse and return the cipher suites, an empty list indicates the default
+func (lc *ListenerConfig) TLSCipherSuiteIDs() ([]uint16, error) {
+	suites := map[string]uint16{}
+
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	// legacy appliances may require a cipher suite considered insecure, this must be configured explicitly
+	for _, suite := range tls.InsecureCipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	if len(lc.TLSCipherSuites) == 0 {
+		return []uint16{}, nil
+	}
+
+	// go ignores the cipher suites for TLS 1.3, so they would silently not apply to most connections
+	max, err := parseTLSVersion(lc.TLSMaxVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	if max == 0 || max > tls.VersionTLS12 {
+		return nil, fmt.Errorf("TLS cipher suites don't apply to TLS 1.3, the maximum version must be 1.2 or lower")
+	}
+
+	ids := make([]uint16, len(lc.TLSCipherSuites))
+
+	for n, name := range lc.TLSCipherSuites {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS cipher suite %s", name)
+		}
+
+		ids[n] = id
+	}
+
+	return ids, nil
+}
+
+// TLSCurveIDs parse and return the curve preferences, an empty list indicates the default
+func (lc *ListenerConfig) TLSCurveIDs() ([]tls.CurveID, error) {
+	ids := make([]tls.CurveID, len(lc.TLSCurves))
+
+	for n, name := range lc.TLSCurves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS curve %s, must be one of X25519, P256, P384 or P521", name)
+		}
+
+		ids[n] = id
+	}
+
+	return ids, nil
+}
+
+func parseTLSVersion(name string) (uint16, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	version, ok := tlsVersions[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %s, must be one of 1.0, 1.1, 1.2 or 1.3", name)
+	}
+
+	return version, nil
+}
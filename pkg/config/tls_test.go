@@ -0,0 +1,79 @@
+package config
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenTLSVersions(t *testing.T) {
+	lc := &ListenerConfig{TLSMinVersion: "1.2", TLSMaxVersion: "1.3"}
+
+	min, max, err := lc.TLSVersions()
+	require.Nil(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), min)
+	require.Equal(t, uint16(tls.VersionTLS13), max)
+
+	lc = &ListenerConfig{}
+
+	min, max, err = lc.TLSVersions()
+	require.Nil(t, err)
+	require.Zero(t, min)
+	require.Zero(t, max)
+
+	lc = &ListenerConfig{TLSMinVersion: "1.3", TLSMaxVersion: "1.2"}
+
+	_, _, err = lc.TLSVersions()
+	require.Error(t, err)
+
+	lc = &ListenerConfig{TLSMinVersion: "TLS1.2"}
+
+	_, _, err = lc.TLSVersions()
+	require.Error(t, err)
+
+	require.Equal(t, "1.2", TLSVersionName(tls.VersionTLS12))
+}
+
+func Test_WhenTLSCipherSuiteIDs(t *testing.T) {
+	lc := &ListenerConfig{TLSMaxVersion: "1.2", TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_AES_128_CBC_SHA256"}}
+
+	ids, err := lc.TLSCipherSuiteIDs()
+	require.Nil(t, err)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA256}, ids)
+
+	lc = &ListenerConfig{TLSMaxVersion: "1.2", TLSCipherSuites: []string{"AES128-GCM-SHA256"}}
+
+	_, err = lc.TLSCipherSuiteIDs()
+	require.Error(t, err)
+
+	// the cipher suites don't apply to TLS 1.3
+	lc = &ListenerConfig{TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+
+	_, err = lc.TLSCipherSuiteIDs()
+	require.Error(t, err)
+
+	lc = &ListenerConfig{TLSMaxVersion: "1.3", TLSCipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+
+	_, err = lc.TLSCipherSuiteIDs()
+	require.Error(t, err)
+
+	lc = &ListenerConfig{}
+
+	ids, err = lc.TLSCipherSuiteIDs()
+	require.Nil(t, err)
+	require.Empty(t, ids)
+}
+
+func Test_WhenTLSCurveIDs(t *testing.T) {
+	lc := &ListenerConfig{TLSCurves: []string{"X25519", "P256"}}
+
+	ids, err := lc.TLSCurveIDs()
+	require.Nil(t, err)
+	require.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, ids)
+
+	lc = &ListenerConfig{TLSCurves: []string{"secp256r1"}}
+
+	_, err = lc.TLSCurveIDs()
+	require.Error(t, err)
+}
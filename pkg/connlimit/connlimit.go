@@ -0,0 +1,371 @@
+package connlimit
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/proxyproto"
+)
+
+// ErrSourceLimit returned when reading from a connection which exceeds the connections allowed from its source address
+var ErrSourceLimit = errors.New("too many connections from source address")
+
+var (
+	limitedConnections   = expvar.NewMap("limited_connections")
+	idleConnections      = expvar.NewMap("idle_connections")
+	throttledConnections = expvar.NewMap("throttled_connections")
+)
+
+// Limiter enforces the connection limits of a listener, tracking the connections accepted
+// from each source and the rate at which each connection sends messages
+type Limiter struct {
+	name    string
+	limits  config.ConnectionLimits
+	total   int
+	sources map[string]int
+	buckets map[string]*bucket
+	lock    sync.Mutex
+}
+
+// NewLimiter create a limiter for the listener, connections to UNIX sockets have no source address
+// so only the listener connection limit and idle timeout apply to them
+func NewLimiter(lc *config.ListenerConfig) *Limiter {
+	limits := lc.ConnectionLimits
+	if lc.IsUnix() {
+		limits.MaxSourceConnections = 0
+		limits.MaxMessageRate = 0
+	}
+
+	return &Limiter{
+		name:    lc.Name,
+		limits:  limits,
+		sources: map[string]int{},
+		buckets: map[string]*bucket{},
+	}
+}
+
+// acquire count a new connection, returns false if the listener is at its limit
+func (l *Limiter) acquire() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits.MaxConnections > 0 && l.total >= l.limits.MaxConnections {
+		return false
+	}
+
+	l.total++
+
+	return true
+}
+
+func (l *Limiter) release() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.total--
+}
+
+// register count the connection against its source address and track its message rate, returns
+// false if the source is at its limit
+func (l *Limiter) register(client string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	source := proxyproto.ClientIP(client)
+
+	if l.limits.MaxSourceConnections > 0 && l.sources[source] >= l.limits.MaxSourceConnections {
+		return false
+	}
+
+	l.sources[source]++
+
+	if l.limits.MaxMessageRate > 0 {
+		l.buckets[client] = newBucket(l.limits.MaxMessageRate, time.Now())
+	}
+
+	return true
+}
+
+func (l *Limiter) unregister(client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	source := proxyproto.ClientIP(client)
+
+	l.sources[source]--
+	if l.sources[source] <= 0 {
+		delete(l.sources, source)
+	}
+
+	delete(l.buckets, client)
+}
+
+// Wait blocks while the connection from the client has exceeded its message rate, count is
+// the number of messages received, clients without a tracked connection aren't limited
+func (l *Limiter) Wait(client string, count int) {
+	l.lock.Lock()
+
+	b, ok := l.buckets[client]
+	if !ok {
+		l.lock.Unlock()
+		return
+	}
+
+	delay, first := b.take(count, time.Now())
+
+	l.lock.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+
+	if first {
+		throttledConnections.Add(l.name, 1)
+		logrus.WithFields(logrus.Fields{
+			"listener": l.name,
+			"client":   client,
+			"limit":    l.limits.MaxMessageRate,
+		}).Warn("connection exceeded message rate, throttling")
+	}
+
+	time.Sleep(delay)
+}
+
+// bucket a token bucket holding up to a second of messages, messages taken beyond the
+// tokens available are repaid by waiting
+type bucket struct {
+	rate      float64
+	tokens    float64
+	last      time.Time
+	throttled bool
+}
+
+func newBucket(rate int, now time.Time) *bucket {
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: now}
+}
+
+// take remove tokens for the messages, returning how long to wait and whether this is the first time the bucket was exhausted
+func (b *bucket) take(count int, now time.Time) (time.Duration, bool) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(count)
+	if b.tokens >= 0 {
+		return 0, false
+	}
+
+	first := !b.throttled
+	b.throttled = true
+
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), first
+}
+
+// the limits a listener enforces on the connections it accepts
+type mode int
+
+const (
+	// the listener and source limits are checked on accept
+	limitAll mode = iota
+	// only the listener limit is checked, on accept
+	limitListener
+	// only the source limit is checked, on the first read
+	limitSource
+)
+
+// Listener enforces the limits on accepted connections, the listener limit is checked on accept, the source limit is
+// checked on accept or when proxying on the first read so the address can come from a proxy protocol header without
+// blocking accept
+type Listener struct {
+	net.Listener
+	limiter *Limiter
+	mode    mode
+}
+
+// NewListener wrap the listener with the limiter, checking both limits on accept
+func NewListener(ln net.Listener, limiter *Limiter) *Listener {
+	return &Listener{Listener: ln, limiter: limiter, mode: limitAll}
+}
+
+// NewConnectionListener wrap the listener with only the listener limit, this wraps the listener beneath
+// a proxy protocol listener so connections which have yet to send their header count against the limit
+func NewConnectionListener(ln net.Listener, limiter *Limiter) *Listener {
+	return &Listener{Listener: ln, limiter: limiter, mode: limitListener}
+}
+
+// NewSourceListener wrap the listener with the source limit, message rate and idle timeout, this wraps a
+// proxy protocol listener so the source is checked on the first read once the header has been read
+func NewSourceListener(ln net.Listener, limiter *Limiter) *Listener {
+	return &Listener{Listener: ln, limiter: limiter, mode: limitSource}
+}
+
+// Accept waits for and returns the next connection within the limits
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		c := &Conn{Conn: conn, limiter: l.limiter, counted: l.mode != limitSource, limited: l.mode != limitListener}
+
+		if c.counted && !l.limiter.acquire() {
+			limitedConnections.Add(l.limiter.name, 1)
+			logrus.WithFields(logrus.Fields{
+				"listener": l.limiter.name,
+				"limit":    l.limiter.limits.MaxConnections,
+			}).Warn("listener connection limit reached, closing connection")
+
+			conn.Close()
+			continue
+		}
+
+		if l.mode != limitAll {
+			return c, nil
+		}
+
+		if c.register() == nil {
+			return c, nil
+		}
+
+		c.Close()
+	}
+}
+
+// Conn a connection counted against the limits, reads are given a deadline when the listener
+// has an idle timeout, combined with any deadline set on the connection such as for a TLS handshake
+type Conn struct {
+	net.Conn
+	limiter *Limiter
+	// whether the connection counts against the listener limit, and whether the source limit,
+	// message rate and idle timeout apply to it
+	counted    bool
+	limited    bool
+	once       sync.Once
+	err        error
+	client     string
+	registered bool
+	closed     bool
+	deadline   time.Time
+	lock       sync.Mutex
+}
+
+// register count the connection against its source, only done once
+func (c *Conn) register() error {
+	c.once.Do(func() {
+		client := c.Conn.RemoteAddr().String()
+
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		if c.closed {
+			c.err = errors.New("connection closed")
+			return
+		}
+
+		if !c.limiter.register(client) {
+			limitedConnections.Add(c.limiter.name, 1)
+			logrus.WithFields(logrus.Fields{
+				"listener": c.limiter.name,
+				"client":   client,
+				"limit":    c.limiter.limits.MaxSourceConnections,
+			}).Warn("source connection limit reached, closing connection")
+
+			c.err = ErrSourceLimit
+			return
+		}
+
+		c.client = client
+		c.registered = true
+	})
+
+	return c.err
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if !c.limited {
+		return c.Conn.Read(b)
+	}
+
+	err := c.register()
+	if err != nil {
+		c.Close()
+		return 0, err
+	}
+
+	timeout := c.limiter.limits.IdleTimeout
+	if timeout <= 0 {
+		return c.Conn.Read(b)
+	}
+
+	c.lock.Lock()
+	deadline, idle := time.Now().Add(timeout), true
+	if !c.deadline.IsZero() && c.deadline.Before(deadline) {
+		deadline, idle = c.deadline, false
+	}
+	c.lock.Unlock()
+
+	err = c.Conn.SetReadDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(b)
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && idle {
+		idleConnections.Add(c.limiter.name, 1)
+		logrus.WithFields(logrus.Fields{
+			"listener": c.limiter.name,
+			"client":   c.client,
+			"timeout":  timeout.String(),
+		}).Info("connection idle, closing connection")
+	}
+
+	return n, err
+}
+
+// SetDeadline set the read and write deadline, the read deadline is combined with the idle timeout
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline set the read deadline, this is combined with the idle timeout
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *Conn) setReadDeadline(t time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.deadline = t
+}
+
+// Close close the connection and release it from the limits
+func (c *Conn) Close() error {
+	c.lock.Lock()
+
+	if !c.closed {
+		c.closed = true
+		if c.counted {
+			c.limiter.release()
+		}
+
+		if c.registered {
+			c.limiter.unregister(c.client)
+		}
+	}
+
+	c.lock.Unlock()
+
+	return c.Conn.Close()
+}
@@ -0,0 +1,243 @@
+package connlimit
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/proxyproto"
+)
+
+func Test_WhenListenerConnectionLimit(t *testing.T) {
+	ln, addr := testListener(t, config.ConnectionLimits{MaxConnections: 1}, false)
+	defer ln.Close()
+
+	first := dial(t, addr)
+	defer first.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	// the second connection is closed by the listener while the first is open
+	second := dial(t, addr)
+	defer second.Close()
+	requireClosed(t, second)
+
+	conn.Close()
+
+	third := dial(t, addr)
+	defer third.Close()
+
+	conn = <-accepted
+	conn.Close()
+}
+
+func Test_WhenSourceConnectionLimit(t *testing.T) {
+	ln, addr := testListener(t, config.ConnectionLimits{MaxSourceConnections: 1}, true)
+	defer ln.Close()
+
+	send := func(source string) net.Conn {
+		client := dial(t, addr)
+		client.Write([]byte("PROXY TCP4 " + source + " 192.0.2.2 56324 443\r\nhello"))
+		return client
+	}
+
+	first := send("198.51.100.1")
+	defer first.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	buf := make([]byte, 5)
+	_, err = conn.Read(buf)
+	require.Nil(t, err)
+
+	second := send("198.51.100.1")
+	defer second.Close()
+
+	limited, err := ln.Accept()
+	require.Nil(t, err)
+
+	_, err = limited.Read(buf)
+	require.Equal(t, ErrSourceLimit, err)
+	requireClosed(t, second)
+
+	// other sources are unaffected
+	third := send("198.51.100.2")
+	defer third.Close()
+
+	other, err := ln.Accept()
+	require.Nil(t, err)
+	_, err = other.Read(buf)
+	require.Nil(t, err)
+
+	other.Close()
+	conn.Close()
+}
+
+func Test_WhenProxyConnectionLimit(t *testing.T) {
+	ln, addr := testListener(t, config.ConnectionLimits{MaxConnections: 2}, true)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// connections which have yet to send their header count against the limit
+	first := dial(t, addr)
+	defer first.Close()
+
+	second := dial(t, addr)
+	defer second.Close()
+
+	third := dial(t, addr)
+	defer third.Close()
+	requireClosed(t, third)
+
+	first.Write([]byte("PROXY TCP4 198.51.100.1 192.0.2.2 56324 443\r\nhello"))
+
+	conn := <-accepted
+	require.Equal(t, "198.51.100.1:56324", conn.RemoteAddr().String())
+
+	// closing the connection releases it from the limit
+	conn.Close()
+
+	fourth := dial(t, addr)
+	defer fourth.Close()
+	fourth.Write([]byte("PROXY TCP4 198.51.100.2 192.0.2.2 56324 443\r\nhello"))
+
+	conn = <-accepted
+	require.Equal(t, "198.51.100.2:56324", conn.RemoteAddr().String())
+	conn.Close()
+}
+
+func Test_WhenIdleTimeout(t *testing.T) {
+	ln, addr := testListener(t, config.ConnectionLimits{IdleTimeout: 50 * time.Millisecond}, false)
+	defer ln.Close()
+
+	client := dial(t, addr)
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Read(make([]byte, 1))
+	ne, ok := err.(net.Error)
+	require.True(t, ok)
+	require.True(t, ne.Timeout())
+}
+
+func Test_WhenDeadlineBeforeIdleTimeout(t *testing.T) {
+	ln, addr := testListener(t, config.ConnectionLimits{IdleTimeout: time.Minute}, false)
+	defer ln.Close()
+
+	client := dial(t, addr)
+	defer client.Close()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(50 * time.Millisecond))
+
+	start := time.Now()
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.True(t, time.Since(start) < time.Minute)
+}
+
+func Test_WhenMessageRateExceeded(t *testing.T) {
+	b := newBucket(10, time.Unix(0, 0))
+
+	delay, first := b.take(10, time.Unix(0, 0))
+	require.Zero(t, delay)
+	require.False(t, first)
+
+	delay, first = b.take(5, time.Unix(0, 0))
+	require.Equal(t, 500*time.Millisecond, delay)
+	require.True(t, first)
+
+	// tokens are refilled over time, but the debt must be repaid first
+	delay, first = b.take(1, time.Unix(1, 0))
+	require.Zero(t, delay)
+	require.False(t, first)
+}
+
+func Test_WhenLimiterWaitUnknownClient(t *testing.T) {
+	limiter := NewLimiter(&config.ListenerConfig{Name: "test", ConnectionLimits: config.ConnectionLimits{MaxMessageRate: 1}})
+
+	require.True(t, limiter.register("127.0.0.1:1234"))
+
+	start := time.Now()
+	limiter.Wait("127.0.0.1:4321", 100)
+	require.True(t, time.Since(start) < 50*time.Millisecond)
+
+	limiter.unregister("127.0.0.1:1234")
+	require.Empty(t, limiter.buckets)
+	require.Empty(t, limiter.sources)
+}
+
+func Test_WhenUnixLimits(t *testing.T) {
+	limiter := NewLimiter(&config.ListenerConfig{
+		Name:             "devlog",
+		Transport:        config.TransportUnix,
+		ConnectionLimits: config.ConnectionLimits{MaxConnections: 10, MaxSourceConnections: 1, MaxMessageRate: 1, IdleTimeout: time.Minute},
+	})
+
+	// every connection to a UNIX socket has the same address
+	require.True(t, limiter.register("@"))
+	require.True(t, limiter.register("@"))
+
+	require.Equal(t, 10, limiter.limits.MaxConnections)
+	require.Equal(t, time.Minute, limiter.limits.IdleTimeout)
+	require.Len(t, limiter.buckets, 0)
+}
+
+func testListener(t *testing.T, limits config.ConnectionLimits, proxy bool) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	addr := ln.Addr().String()
+
+	limiter := NewLimiter(&config.ListenerConfig{Name: "test", ConnectionLimits: limits})
+
+	if proxy {
+		return NewSourceListener(proxyproto.NewListener(NewConnectionListener(ln, limiter), &proxyproto.Config{}), limiter), addr
+	}
+
+	return NewListener(ln, limiter), addr
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+
+	return conn
+}
+
+func requireClosed(t *testing.T, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	data, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Empty(t, data)
+}
@@ -1,64 +1,113 @@
 package cwlogs
 
 import (
-	"encoding/json"
-	"errors"
 	"regexp"
 	"sync"
+	"time"
 
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/versent/syslog-cloudlogs/pkg/batching"
 	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/deadletter"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
 )
 
-var sequenceMatcher = regexp.MustCompile(`The given sequenceToken is invalid. The next expected sequenceToken is: (.+)`)
+var (
+	sequenceMatcher = regexp.MustCompile(`The given sequenceToken is invalid. The next expected sequenceToken is: (.+)`)
+	acceptedMatcher = regexp.MustCompile(`The next batch can be sent with sequenceToken: (.+)`)
+)
 
 // Dispatcher dispatches logs to cloudwatch
 type Dispatcher struct {
-	config        *config.SyslogConfig
-	session       *session.Session
-	sequenceToken string
-	lock          *sync.Mutex // just to be safe with sequenceToken
-	svc           *cloudwatchlogs.CloudWatchLogs
+	config         *config.SyslogConfig
+	session        *session.Session
+	router         *Router
+	sequenceTokens map[config.Route]string
+	lock           *sync.Mutex // just to be safe with sequenceTokens
+	svc            cloudwatchlogsiface.CloudWatchLogsAPI
+	// policies overriding the default oversize policy for each destination
+	oversizePolicies map[config.Route]string
+	deadLetter       deadletter.Sink
+	// waits between retries, replaced in tests
+	sleeper func(time.Duration)
 }
 
 // NewDispatcher create a new dispatcher
-func NewDispatcher(config *config.SyslogConfig) (*Dispatcher, error) {
+func NewDispatcher(conf *config.SyslogConfig) (*Dispatcher, error) {
 
 	var options session.Options
 
-	if config.Region != "" {
+	if conf.Region != "" {
 		options = session.Options{
 			Config: aws.Config{
-				Region: aws.String(config.Region),
+				Region: aws.String(conf.Region),
 			},
 		}
 	}
 
-	if config.Profile != "" {
-		options.Profile = config.Profile
+	if conf.Profile != "" {
+		options.Profile = conf.Profile
+	}
+
+	router, err := NewRouter(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	oversizePolicies, err := conf.DestinationOversizePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	var sink deadletter.Sink
+
+	if path := conf.DeadLetterPath(); path != "" {
+		sink, err = deadletter.NewFileSink(path)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	sess := session.Must(session.NewSessionWithOptions(options))
 
 	return &Dispatcher{
-		config:  config,
-		session: sess,
-		lock:    &sync.Mutex{},
-		svc:     cloudwatchlogs.New(sess),
+		config:           conf,
+		session:          sess,
+		router:           router,
+		sequenceTokens:   map[config.Route]string{},
+		lock:             &sync.Mutex{},
+		svc:              cloudwatchlogs.New(sess),
+		oversizePolicies: oversizePolicies,
+		deadLetter:       sink,
 	}, nil
 }
 
-// SetupCloudwatch create cloudwatch group and stream
+// SetupCloudwatch create cloudwatch groups and streams for all routes
 func (d *Dispatcher) SetupCloudwatch() error {
 
+	groups := map[string]bool{}
+
+	for _, route := range d.router.Routes() {
+		if !groups[route.Group] {
+			d.createLogGroup(route.Group)
+			groups[route.Group] = true
+		}
+
+		d.createLogStream(route)
+	}
+
+	return nil
+}
+
+func (d *Dispatcher) createLogGroup(group string) {
 	_, err := d.svc.CreateLogGroup(&cloudwatchlogs.CreateLogGroupInput{
-		LogGroupName: aws.String(d.config.Group),
+		LogGroupName: aws.String(group),
 	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
@@ -68,10 +117,12 @@ func (d *Dispatcher) SetupCloudwatch() error {
 			logrus.WithError(err).Warn("cloudwatch log group already exists")
 		}
 	}
+}
 
-	_, err = d.svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
-		LogGroupName:  aws.String(d.config.Group),
-		LogStreamName: aws.String(d.config.Stream),
+func (d *Dispatcher) createLogStream(route config.Route) {
+	_, err := d.svc.CreateLogStream(&cloudwatchlogs.CreateLogStreamInput{
+		LogGroupName:  aws.String(route.Group),
+		LogStreamName: aws.String(route.Stream),
 	})
 	if err != nil {
 		if awsErr, ok := err.(awserr.Error); ok {
@@ -81,8 +132,6 @@ func (d *Dispatcher) SetupCloudwatch() error {
 			logrus.WithError(err).Warn("cloudwatch log stream already exists")
 		}
 	}
-
-	return nil
 }
 
 // Dispatch handle entries and send them to cloudwatch
@@ -90,86 +139,97 @@ func (d *Dispatcher) Dispatch(entries []*batching.LogEntry) {
 
 	logrus.Info("dispatch")
 
+	now := time.Now()
+
+	for _, batch := range d.router.partition(entries) {
+		routed := d.applyTimestampPolicy(batch.route, batch.entries, now)
+		routed = d.applyOversizePolicy(batch.route, routed)
+
+		sortEntries(routed)
+
+		// splitting events may take the batch over the limits of a single request, sorting
+		// first means each request spans as little time as possible
+		for _, chunk := range batching.Chunk(routed) {
+			d.dispatchRoute(batch.route, chunk)
+		}
+	}
+}
+
+func (d *Dispatcher) dispatchRoute(route config.Route, entries []*batching.LogEntry) {
+
+	// entries which can't be encoded are left out, so the remaining entries line up with the events
+	events, entries := d.transformEntriesToEvents(entries)
+	if len(events) == 0 {
+		return
+	}
+
 	params := &cloudwatchlogs.PutLogEventsInput{
-		LogEvents:     d.transformEntriesToEvents(entries),
-		LogGroupName:  aws.String(d.config.Group),
-		LogStreamName: aws.String(d.config.Stream),
+		LogEvents:     events,
+		LogGroupName:  aws.String(route.Group),
+		LogStreamName: aws.String(route.Stream),
 	}
 
+	d.lock.Lock()
+	sequenceToken := d.sequenceTokens[route]
+	d.lock.Unlock()
+
 	// first request has no SequenceToken - in all subsequent request we set it
-	if d.sequenceToken != "" {
-		params.SequenceToken = aws.String(d.sequenceToken)
+	if sequenceToken != "" {
+		params.SequenceToken = aws.String(sequenceToken)
 	}
 
 	resp, err := d.putLogEvents(params)
 	if err != nil {
-		logrus.Fatalln(err)
+		d.dispatchFailed(route, entries, err)
+		return
 	}
 
 	d.lock.Lock()
-	d.sequenceToken = *resp.NextSequenceToken
+	d.sequenceTokens[route] = aws.StringValue(resp.NextSequenceToken)
 	d.lock.Unlock()
 
-	logrus.WithField("sequenceToken", d.sequenceToken).Info("cwlogs sequence update")
+	d.handleRejected(route, entries, resp.RejectedLogEventsInfo)
+
+	// let senders waiting on delivery know the entries have been persisted
+	batching.AckEntries(entries, nil)
+
+	logrus.WithFields(logrus.Fields{
+		"group":         route.Group,
+		"stream":        route.Stream,
+		"sequenceToken": aws.StringValue(resp.NextSequenceToken),
+	}).Info("cwlogs sequence update")
 }
 
-func (d *Dispatcher) transformEntriesToEvents(entries []*batching.LogEntry) []*cloudwatchlogs.InputLogEvent {
+// transformEntriesToEvents returns the events and the entries they were encoded from, in the same order,
+// entries which can't be encoded are acknowledged with the error
+func (d *Dispatcher) transformEntriesToEvents(entries []*batching.LogEntry) ([]*cloudwatchlogs.InputLogEvent, []*batching.LogEntry) {
 
-	events := make([]*cloudwatchlogs.InputLogEvent, len(entries))
+	events := make([]*cloudwatchlogs.InputLogEvent, 0, len(entries))
+	encoded := make([]*batching.LogEntry, 0, len(entries))
 
-	for n, entry := range entries {
-		data, err := json.Marshal(entry.Parts)
+	for _, entry := range entries {
+		// the batcher has already encoded the entry to measure it
+		data, err := entry.Encoded()
 		if err != nil {
+			dispatchFailures.Add(failedEncode, 1)
 			logrus.WithError(err).Error("unable to marshal log entry into json")
+
+			batching.AckEntries([]*batching.LogEntry{entry}, &dispatchError{reason: failedEncode, err: err})
 			continue
 		}
 
-		events[n] = &cloudwatchlogs.InputLogEvent{
+		events = append(events, &cloudwatchlogs.InputLogEvent{
 			Message:   aws.String(string(data)),
 			Timestamp: aws.Int64(entry.MilliTimestamp),
-		}
-	}
-
-	return events
-}
-
-func (d *Dispatcher) putLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
-	var (
-		seq  string
-		err  error
-		resp *cloudwatchlogs.PutLogEventsOutput
-	)
-
-	resp, err = d.svc.PutLogEvents(input)
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			if awsErr.Code() == "InvalidSequenceTokenException" {
-
-				logrus.WithError(err).Warn("retry sending due to sequence resume")
-
-				// this section just pulls the sequence out of the message
-				// and then set it in the request
-				seq, err = extractSeq(awsErr.Message())
-				if err != nil {
-					logrus.Fatalln(err)
-				}
-
-				input.SequenceToken = aws.String(seq)
-
-				resp, err = d.svc.PutLogEvents(input)
-				if err != nil {
-					logrus.Fatalln(err)
-				}
-
-			}
-		}
+		})
+		encoded = append(encoded, entry)
 	}
 
-	return resp, err
+	return events, encoded
 }
 
-func extractSeq(msg string) (string, error) {
-	res := sequenceMatcher.FindStringSubmatch(msg)
+func extractSeq(matcher *regexp.Regexp, msg string) (string, error) {
+	res := matcher.FindStringSubmatch(msg)
 
 	if len(res) != 2 {
 		return "", errors.New("Missing sequence in message")
@@ -1,11 +1,19 @@
 package cwlogs
 
 import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/stretchr/testify/require"
 	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/deadletter"
 	"github.com/wolfeidau/go-syslog/format"
 )
 
@@ -22,7 +30,60 @@ func TestTransformEntriesToEvents(t *testing.T) {
 		},
 	}
 
-	events := dispatcher.transformEntriesToEvents(le)
+	events, encoded := dispatcher.transformEntriesToEvents(le)
 
 	require.Len(t, events, 1)
+	require.Equal(t, le, encoded)
+}
+
+func TestDispatchRouteEncodeFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cwlogs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := deadletter.NewFileSink(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	defer sink.Close()
+
+	// the first event uploaded is too old
+	svc := &fakeLogs{rejected: &cloudwatchlogs.RejectedLogEventsInfo{TooOldLogEventEndIndex: aws.Int64(1)}}
+
+	delays := []time.Duration{}
+	dispatcher := newRetryDispatcher(svc, &delays)
+	dispatcher.deadLetter = sink
+
+	acked := map[string]error{}
+	entries := []*batching.LogEntry{}
+
+	for _, content := range []string{"invalid", "old", "new"} {
+		parts := format.LogParts{"content": content, "timestamp": time.Now()}
+		if content == "invalid" {
+			// values which can't be encoded as JSON
+			parts["value"] = math.Inf(1)
+		}
+
+		entry := batching.NewLogEntry(parts)
+		entry.Ack = func(content string) batching.AckFunc {
+			return func(err error) { acked[content] = err }
+		}(content)
+
+		entries = append(entries, entry)
+	}
+
+	dispatcher.dispatchRoute(config.Route{Group: "/apigee/encode", Stream: "apigee"}, entries)
+
+	require.Len(t, svc.inputs, 1)
+	require.Len(t, svc.inputs[0].LogEvents, 2)
+
+	require.Len(t, acked, 3)
+	require.Error(t, acked["invalid"])
+	require.False(t, batching.IsRetriable(acked["invalid"]))
+	require.Nil(t, acked["old"])
+	require.Nil(t, acked["new"])
+
+	// the rejected event is attributed to the entry it was encoded from
+	data, err := ioutil.ReadFile(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"content":"old"`)
+	require.NotContains(t, string(data), `"content":"new"`)
 }
@@ -0,0 +1,272 @@
+package cwlogs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// fields added to events which have been truncated or split
+const (
+	FieldTruncated    = "truncated"
+	FieldOriginalSize = "original_size"
+	FieldSplitID      = "split_id"
+	FieldSplitPart    = "split_part"
+	FieldSplitTotal   = "split_total"
+)
+
+// fields kept alongside the encoded entry when it's the entry, rather than its content, which is truncated or split
+var oversizeFields = []string{"timestamp", "listener", "transport", "client_ip", "tls_peer"}
+
+var oversizeEvents = expvar.NewMap("oversize_events")
+
+// applyOversizePolicy truncate, split or dead letter the entries which are too large to upload to the route
+func (d *Dispatcher) applyOversizePolicy(route config.Route, entries []*batching.LogEntry) []*batching.LogEntry {
+	policy, ok := d.oversizePolicies[route]
+	if !ok {
+		policy = d.config.OversizePolicy
+	}
+
+	result := make([]*batching.LogEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		size, err := entry.EventSize()
+		if err != nil || size <= batching.MaxEventSize {
+			result = append(result, entry)
+			continue
+		}
+
+		fields := logrus.Fields{"group": route.Group, "stream": route.Stream, "size": size, "policy": policy}
+
+		var replacements []*batching.LogEntry
+
+		switch policy {
+		case config.OversizeSplit:
+			replacements, err = SplitEntry(entry, batching.MaxEventSize)
+		case config.OversizeDeadLetter:
+			err = d.deadLetter.Write(route, "oversize", []*batching.LogEntry{entry})
+			if err == nil {
+				// the entry won't be retried once it's in the dead letter sink
+				batching.AckEntries([]*batching.LogEntry{entry}, nil)
+			}
+		default:
+			var truncated *batching.LogEntry
+			truncated, err = TruncateEntry(entry, batching.MaxEventSize)
+			replacements = []*batching.LogEntry{truncated}
+		}
+
+		if err != nil {
+			oversizeEvents.Add("failed", 1)
+			logrus.WithError(err).WithFields(fields).Error("oversize event dropped")
+			batching.AckEntries([]*batching.LogEntry{entry}, &dispatchError{reason: failedOversize, err: err})
+			continue
+		}
+
+		oversizeEvents.Add(policy, 1)
+		logrus.WithFields(fields).WithField("events", len(replacements)).Warn("oversize event")
+
+		result = append(result, replacements...)
+	}
+
+	return result
+}
+
+// TruncateEntry returns an entry which fits within the max event size by truncating its content,
+// marked with the truncated field and the size of the original event
+func TruncateEntry(entry *batching.LogEntry, maxSize int) (*batching.LogEntry, error) {
+	size, err := entry.EventSize()
+	if err != nil {
+		return nil, err
+	}
+
+	body, rest, err := oversizeBody(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	rest[FieldTruncated] = true
+	rest[FieldOriginalSize] = size
+
+	budget, err := bodyBudget(rest, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	head, _ := cutJSON(body, budget)
+
+	return newOversizeEntry(entry, rest, head, entry.Ack), nil
+}
+
+// SplitEntry returns entries which each fit within the max event size holding consecutive parts of the content,
+// each is numbered from 1 and shares an ID so the content can be reassembled
+func SplitEntry(entry *batching.LogEntry, maxSize int) ([]*batching.LogEntry, error) {
+	body, rest, err := oversizeBody(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := newSplitID()
+	if err != nil {
+		return nil, err
+	}
+
+	// the budget is measured using the largest values the part numbers could have
+	rest[FieldSplitID] = id
+	rest[FieldSplitPart] = len(body)
+	rest[FieldSplitTotal] = len(body)
+
+	budget, err := bodyBudget(rest, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	pieces := []string{}
+
+	for body != "" {
+		var head string
+
+		head, body = cutJSON(body, budget)
+		if head == "" {
+			return nil, errors.New("event content can't be split within the max event size")
+		}
+
+		pieces = append(pieces, head)
+	}
+
+	ack := batching.JoinAck(len(pieces), entry.Ack)
+	entries := make([]*batching.LogEntry, len(pieces))
+
+	for n, piece := range pieces {
+		parts := copyParts(rest)
+		parts[FieldSplitPart] = n + 1
+		parts[FieldSplitTotal] = len(pieces)
+
+		entries[n] = newOversizeEntry(entry, parts, piece, ack)
+	}
+
+	return entries, nil
+}
+
+// oversizeBody returns the text which is truncated or split and the parts kept with it, this is the content
+// of the entry, unless the rest of the entry is also too large, in which case it's the entire encoded entry
+func oversizeBody(entry *batching.LogEntry) (string, map[string]interface{}, error) {
+	if content, ok := entry.Parts["content"].(string); ok {
+		rest := copyParts(entry.Parts)
+		delete(rest, "content")
+
+		data, err := json.Marshal(rest)
+		if err != nil {
+			return "", nil, err
+		}
+
+		if len(data) < batching.MaxEventSize/2 {
+			return content, rest, nil
+		}
+	}
+
+	data, err := entry.Encoded()
+	if err != nil {
+		return "", nil, err
+	}
+
+	rest := map[string]interface{}{}
+
+	for _, field := range oversizeFields {
+		if value, ok := entry.Parts[field]; ok {
+			rest[field] = value
+		}
+	}
+
+	return string(data), rest, nil
+}
+
+// bodyBudget returns the encoded size available for the content of an event with the parts
+func bodyBudget(parts map[string]interface{}, maxSize int) (int, error) {
+	withContent := copyParts(parts)
+	withContent["content"] = ""
+
+	data, err := json.Marshal(withContent)
+	if err != nil {
+		return 0, err
+	}
+
+	budget := maxSize - batching.EventOverhead - len(data)
+	if budget <= 0 {
+		return 0, errors.New("event fields exceed the max event size")
+	}
+
+	return budget, nil
+}
+
+func newOversizeEntry(entry *batching.LogEntry, rest map[string]interface{}, content string, ack batching.AckFunc) *batching.LogEntry {
+	parts := copyParts(rest)
+	parts["content"] = content
+
+	return &batching.LogEntry{
+		Message:        content,
+		Parts:          parts,
+		MilliTimestamp: entry.MilliTimestamp,
+		Ack:            ack,
+	}
+}
+
+func copyParts(parts map[string]interface{}) map[string]interface{} {
+	result := make(map[string]interface{}, len(parts)+1)
+
+	for k, v := range parts {
+		result[k] = v
+	}
+
+	return result
+}
+
+func newSplitID() (string, error) {
+	id := make([]byte, 16)
+
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate split ID")
+	}
+
+	return hex.EncodeToString(id), nil
+}
+
+// cutJSON returns the longest prefix of s, ending on a rune boundary, which is no larger than
+// limit once encoded as JSON, excluding the quotes, and the remainder
+func cutJSON(s string, limit int) (string, string) {
+	size := 0
+
+	for i := 0; i < len(s); {
+		r, n := utf8.DecodeRuneInString(s[i:])
+
+		size += escapedLen(r, n)
+		if size > limit {
+			return s[:i], s[i:]
+		}
+
+		i += n
+	}
+
+	return s, ""
+}
+
+// escapedLen returns the size of the rune once encoded by encoding/json, erring on the larger side
+func escapedLen(r rune, n int) int {
+	switch {
+	case r == utf8.RuneError && n == 1:
+		return 6
+	case r == '"' || r == '\\' || r == '\n' || r == '\r' || r == '\t':
+		return 2
+	case r < 0x20 || r == '<' || r == '>' || r == '&' || r == '\u2028' || r == '\u2029':
+		return 6
+	}
+
+	return n
+}
@@ -0,0 +1,171 @@
+package cwlogs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/deadletter"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+func TestTruncateEntry(t *testing.T) {
+	acked := []error{}
+
+	entry := batching.NewLogEntry(format.LogParts{
+		"content":   strings.Repeat("<a>", 100000),
+		"timestamp": time.Now(),
+		"hostname":  "web-1",
+	})
+	entry.Ack = func(err error) { acked = append(acked, err) }
+
+	originalSize, err := entry.EventSize()
+	require.Nil(t, err)
+
+	truncated, err := TruncateEntry(entry, batching.MaxEventSize)
+	require.Nil(t, err)
+
+	size, err := truncated.EventSize()
+	require.Nil(t, err)
+	require.True(t, size <= batching.MaxEventSize)
+
+	require.Equal(t, true, truncated.Parts[FieldTruncated])
+	require.Equal(t, originalSize, truncated.Parts[FieldOriginalSize])
+	require.Equal(t, "web-1", truncated.Parts["hostname"])
+	require.Equal(t, entry.MilliTimestamp, truncated.MilliTimestamp)
+
+	content := truncated.Parts["content"].(string)
+	require.True(t, strings.HasPrefix(entry.Message, content))
+	require.True(t, len(content) > 0)
+
+	truncated.Ack(nil)
+	require.Equal(t, []error{nil}, acked)
+}
+
+func TestSplitEntry(t *testing.T) {
+	acked := []error{}
+
+	content := strings.Repeat("abcdé\"", 100000)
+
+	entry := batching.NewLogEntry(format.LogParts{
+		"content":   content,
+		"timestamp": time.Now(),
+	})
+	entry.Ack = func(err error) { acked = append(acked, err) }
+
+	entries, err := SplitEntry(entry, batching.MaxEventSize)
+	require.Nil(t, err)
+	require.True(t, len(entries) > 1)
+
+	rejoined := ""
+
+	for n, split := range entries {
+		size, err := split.EventSize()
+		require.Nil(t, err)
+		require.True(t, size <= batching.MaxEventSize)
+
+		require.Equal(t, entries[0].Parts[FieldSplitID], split.Parts[FieldSplitID])
+		require.Equal(t, n+1, split.Parts[FieldSplitPart])
+		require.Equal(t, len(entries), split.Parts[FieldSplitTotal])
+
+		rejoined += split.Parts["content"].(string)
+	}
+
+	require.Equal(t, content, rejoined)
+
+	// the original entry is acknowledged once every part has been
+	for _, split := range entries[1:] {
+		split.Ack(nil)
+	}
+	require.Empty(t, acked)
+
+	entries[0].Ack(nil)
+	require.Equal(t, []error{nil}, acked)
+}
+
+func TestSplitEntryWithoutContent(t *testing.T) {
+	entry := batching.NewLogEntry(format.LogParts{
+		"message":   strings.Repeat("a", 300000),
+		"listener":  "http",
+		"timestamp": time.Now(),
+	})
+
+	entries, err := SplitEntry(entry, batching.MaxEventSize)
+	require.Nil(t, err)
+	require.Len(t, entries, 2)
+
+	// the encoded entry is split and the listener kept with each part
+	encoded, err := entry.Encoded()
+	require.Nil(t, err)
+
+	require.Equal(t, string(encoded), entries[0].Parts["content"].(string)+entries[1].Parts["content"].(string))
+	require.Equal(t, "http", entries[1].Parts["listener"])
+}
+
+func TestApplyOversizePolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cwlogs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := deadletter.NewFileSink(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	defer sink.Close()
+
+	split := config.Route{Group: "/apigee/split", Stream: "apigee"}
+	dead := config.Route{Group: "/apigee/dead", Stream: "apigee"}
+
+	dispatcher := &Dispatcher{
+		config:           &config.SyslogConfig{OversizePolicy: config.OversizeTruncate},
+		oversizePolicies: map[config.Route]string{split: config.OversizeSplit, dead: config.OversizeDeadLetter},
+		deadLetter:       sink,
+	}
+
+	newEntries := func() []*batching.LogEntry {
+		return []*batching.LogEntry{
+			batching.NewLogEntry(format.LogParts{"content": "small", "timestamp": time.Now()}),
+			batching.NewLogEntry(format.LogParts{"content": strings.Repeat("a", 600000), "timestamp": time.Now()}),
+		}
+	}
+
+	entries := dispatcher.applyOversizePolicy(config.Route{Group: "/apigee/default", Stream: "apigee"}, newEntries())
+	require.Len(t, entries, 2)
+	require.Equal(t, true, entries[1].Parts[FieldTruncated])
+
+	entries = dispatcher.applyOversizePolicy(split, newEntries())
+	require.Len(t, entries, 4)
+	require.Equal(t, 3, entries[1].Parts[FieldSplitTotal])
+
+	acked := []error{}
+
+	deadEntries := newEntries()
+	deadEntries[1].Ack = func(err error) { acked = append(acked, err) }
+
+	entries = dispatcher.applyOversizePolicy(dead, deadEntries)
+	require.Len(t, entries, 1)
+	require.Equal(t, "small", entries[0].Message)
+	require.Equal(t, []error{nil}, acked)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"reason":"oversize"`)
+}
+
+func TestCutJSON(t *testing.T) {
+	head, tail := cutJSON("ab<cd", 4)
+	require.Equal(t, "ab", head)
+	require.Equal(t, "<cd", tail)
+
+	head, tail = cutJSON("aéb", 2)
+	require.Equal(t, "a", head)
+	require.Equal(t, "éb", tail)
+
+	head, tail = cutJSON("abc", 10)
+	require.Equal(t, "abc", head)
+	require.Equal(t, "", tail)
+}
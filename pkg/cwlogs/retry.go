@@ -0,0 +1,217 @@
+package cwlogs
+
+import (
+	"expvar"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// classes of error returned by PutLogEvents
+const (
+	errorThrottled = "throttled"
+	errorServer    = "server"
+	errorNetwork   = "network"
+	errorSequence  = "sequence"
+	errorAccepted  = "accepted"
+	errorOther     = "other"
+)
+
+// reasons uploads fail, used when dead lettering the events
+const (
+	failedNonRetriable = "put_failed"
+	failedExhausted    = "retries_exhausted"
+	failedEncode       = "encode_failed"
+	failedOversize     = "oversize_failed"
+)
+
+// sequence token conflicts are retried immediately this many times before backing off,
+// other writers to the stream can cause repeated conflicts
+const maxSequenceRetries = 3
+
+var (
+	dispatchRetries  = expvar.NewMap("dispatch_retries")
+	dispatchFailures = expvar.NewMap("dispatch_failures")
+)
+
+// dispatchError an upload which failed, either because the error isn't retriable or the retries ran out
+type dispatchError struct {
+	reason string
+	err    error
+}
+
+func (e *dispatchError) Error() string {
+	return e.reason + ": " + e.err.Error()
+}
+
+// Retriable returns true if dispatching the events again could succeed, only when the retries ran out, the
+// other reasons are caused by the events themselves or a request cloudwatch won't accept
+func (e *dispatchError) Retriable() bool {
+	return e.reason == failedExhausted
+}
+
+// classifyError returns the class of the error returned by PutLogEvents, throttling, server and network
+// errors are retried with backoff, sequence token errors are retried with the expected token
+func classifyError(err error) string {
+	if awsErr, ok := err.(awserr.Error); ok {
+		switch awsErr.Code() {
+		case cloudwatchlogs.ErrCodeInvalidSequenceTokenException:
+			return errorSequence
+		case cloudwatchlogs.ErrCodeDataAlreadyAcceptedException:
+			return errorAccepted
+		case "ThrottlingException", "Throttling", "RequestLimitExceeded", "TooManyRequestsException":
+			return errorThrottled
+		case cloudwatchlogs.ErrCodeServiceUnavailableException:
+			return errorServer
+		case "RequestError", "ResponseTimeout":
+			// the request couldn't be sent or the response wasn't received
+			return errorNetwork
+		}
+
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			switch {
+			case reqErr.StatusCode() == 429:
+				return errorThrottled
+			case reqErr.StatusCode() >= 500:
+				return errorServer
+			}
+		}
+
+		if _, ok := awsErr.OrigErr().(net.Error); ok {
+			return errorNetwork
+		}
+
+		return errorOther
+	}
+
+	if _, ok := err.(net.Error); ok {
+		return errorNetwork
+	}
+
+	return errorOther
+}
+
+// putLogEvents upload the events, retrying with backoff until the retry timeout passes
+func (d *Dispatcher) putLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	deadline := time.Now().Add(d.config.RetryTimeout)
+	sequenceRetries := 0
+
+	for attempt := 0; ; attempt++ {
+		resp, err := d.svc.PutLogEvents(input)
+		if err == nil {
+			return resp, nil
+		}
+
+		class := classifyError(err)
+		fields := logrus.Fields{
+			"group":   aws.StringValue(input.LogGroupName),
+			"stream":  aws.StringValue(input.LogStreamName),
+			"attempt": attempt + 1,
+			"class":   class,
+		}
+
+		switch class {
+		case errorAccepted:
+			// a previous attempt which appeared to fail was accepted, carry on from the token it returned
+			seq, seqErr := extractSeq(acceptedMatcher, err.(awserr.Error).Message())
+			if seqErr != nil {
+				return nil, &dispatchError{reason: failedNonRetriable, err: err}
+			}
+
+			logrus.WithFields(fields).Warn("cloudwatch already accepted log events")
+
+			return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String(seq)}, nil
+		case errorSequence:
+			seq, seqErr := extractSeq(sequenceMatcher, err.(awserr.Error).Message())
+			if seqErr != nil {
+				return nil, &dispatchError{reason: failedNonRetriable, err: err}
+			}
+
+			input.SequenceToken = aws.String(seq)
+
+			sequenceRetries++
+			if sequenceRetries <= maxSequenceRetries {
+				dispatchRetries.Add(class, 1)
+				logrus.WithError(err).WithFields(fields).Warn("retry sending due to sequence resume")
+				continue
+			}
+		case errorOther:
+			return nil, &dispatchError{reason: failedNonRetriable, err: err}
+		}
+
+		delay := d.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return nil, &dispatchError{reason: failedExhausted, err: err}
+		}
+
+		dispatchRetries.Add(class, 1)
+		logrus.WithError(err).WithFields(fields).WithField("delay", delay.String()).Warn("retry sending after backoff")
+
+		d.sleep(delay)
+	}
+}
+
+// backoff returns the delay before retrying, a random duration up to the base delay doubled for each attempt,
+// capped at the max delay, so dispatchers retrying at the same time spread out
+func (d *Dispatcher) backoff(attempt int) time.Duration {
+	ceiling := d.config.RetryBaseDelay
+	for n := 0; n < attempt && ceiling < d.config.RetryMaxDelay; n++ {
+		ceiling *= 2
+	}
+	if ceiling > d.config.RetryMaxDelay {
+		ceiling = d.config.RetryMaxDelay
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+func (d *Dispatcher) sleep(delay time.Duration) {
+	if d.sleeper != nil {
+		d.sleeper(delay)
+		return
+	}
+
+	time.Sleep(delay)
+}
+
+// dispatchFailed log and count the entries which couldn't be uploaded, writing them to the dead letter sink if
+// there is one, otherwise they're acknowledged with the error so senders waiting on delivery can retry
+func (d *Dispatcher) dispatchFailed(route config.Route, entries []*batching.LogEntry, err error) {
+	reason := failedNonRetriable
+	if de, ok := err.(*dispatchError); ok {
+		reason = de.reason
+	}
+
+	dispatchFailures.Add(reason, int64(len(entries)))
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"group":  route.Group,
+		"stream": route.Stream,
+		"reason": reason,
+		"events": len(entries),
+	}).Error("cloudwatch upload failed")
+
+	if d.deadLetter != nil {
+		dlErr := d.deadLetter.Write(route, reason, entries)
+		if dlErr == nil {
+			// the entries won't be retried once they're in the dead letter sink
+			batching.AckEntries(entries, nil)
+			return
+		}
+
+		logrus.WithError(dlErr).WithField("reason", reason).Error("dead letter write failed")
+	}
+
+	batching.AckEntries(entries, errors.Wrap(err, "failed to upload log events"))
+}
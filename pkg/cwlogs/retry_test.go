@@ -0,0 +1,207 @@
+package cwlogs
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/deadletter"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+// fakeLogs returns the errors in order from PutLogEvents, then succeeds reporting any rejected events
+type fakeLogs struct {
+	cloudwatchlogsiface.CloudWatchLogsAPI
+	errs     []error
+	rejected *cloudwatchlogs.RejectedLogEventsInfo
+	inputs   []*cloudwatchlogs.PutLogEventsInput
+}
+
+func (f *fakeLogs) PutLogEvents(input *cloudwatchlogs.PutLogEventsInput) (*cloudwatchlogs.PutLogEventsOutput, error) {
+	f.inputs = append(f.inputs, input)
+
+	if len(f.inputs) <= len(f.errs) {
+		return nil, f.errs[len(f.inputs)-1]
+	}
+
+	return &cloudwatchlogs.PutLogEventsOutput{NextSequenceToken: aws.String("next"), RejectedLogEventsInfo: f.rejected}, nil
+}
+
+func newRetryDispatcher(svc cloudwatchlogsiface.CloudWatchLogsAPI, delays *[]time.Duration) *Dispatcher {
+	return &Dispatcher{
+		config: &config.SyslogConfig{
+			RetryTimeout:   time.Minute,
+			RetryBaseDelay: 100 * time.Millisecond,
+			RetryMaxDelay:  time.Second,
+		},
+		sequenceTokens: map[config.Route]string{},
+		lock:           &sync.Mutex{},
+		svc:            svc,
+		sleeper:        func(delay time.Duration) { *delays = append(*delays, delay) },
+	}
+}
+
+func newRetryEntries(acked *[]error) []*batching.LogEntry {
+	entry := batching.NewLogEntry(format.LogParts{"content": "retry", "timestamp": time.Now()})
+	entry.Ack = func(err error) { *acked = append(*acked, err) }
+
+	return []*batching.LogEntry{entry}
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{awserr.New("ThrottlingException", "Rate exceeded", nil), errorThrottled},
+		{awserr.New(cloudwatchlogs.ErrCodeServiceUnavailableException, "unavailable", nil), errorServer},
+		{awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 503, "id"), errorServer},
+		{awserr.NewRequestFailure(awserr.New("Unknown", "slow down", nil), 429, "id"), errorThrottled},
+		{awserr.New("RequestError", "send request failed", errors.New("connection reset")), errorNetwork},
+		{&netError{}, errorNetwork},
+		{awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "invalid", nil), errorSequence},
+		{awserr.New(cloudwatchlogs.ErrCodeDataAlreadyAcceptedException, "accepted", nil), errorAccepted},
+		{awserr.NewRequestFailure(awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "missing", nil), 400, "id"), errorOther},
+		{awserr.New(cloudwatchlogs.ErrCodeInvalidParameterException, "invalid", nil), errorOther},
+		{errors.New("unknown"), errorOther},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.class, classifyError(tt.err), tt.err.Error())
+	}
+}
+
+func TestDispatchRouteRetries(t *testing.T) {
+	svc := &fakeLogs{errs: []error{
+		awserr.New("ThrottlingException", "Rate exceeded", nil),
+		awserr.NewRequestFailure(awserr.New("InternalFailure", "oops", nil), 500, "id"),
+		awserr.New(cloudwatchlogs.ErrCodeInvalidSequenceTokenException, "The given sequenceToken is invalid. The next expected sequenceToken is: 1234", nil),
+	}}
+
+	delays := []time.Duration{}
+	dispatcher := newRetryDispatcher(svc, &delays)
+
+	acked := []error{}
+	route := config.Route{Group: "/apigee/retry", Stream: "apigee"}
+
+	dispatcher.dispatchRoute(route, newRetryEntries(&acked))
+
+	require.Len(t, svc.inputs, 4)
+	require.Equal(t, "1234", aws.StringValue(svc.inputs[3].SequenceToken))
+
+	// sequence token conflicts are retried without waiting
+	require.Len(t, delays, 2)
+	require.True(t, delays[0] <= 100*time.Millisecond)
+	require.True(t, delays[1] <= 200*time.Millisecond)
+
+	require.Equal(t, []error{nil}, acked)
+	require.Equal(t, "next", dispatcher.sequenceTokens[route])
+}
+
+func TestDispatchRouteAlreadyAccepted(t *testing.T) {
+	svc := &fakeLogs{errs: []error{
+		awserr.New(cloudwatchlogs.ErrCodeDataAlreadyAcceptedException, "The given batch of log events has already been accepted. The next batch can be sent with sequenceToken: 5678", nil),
+	}}
+
+	delays := []time.Duration{}
+	dispatcher := newRetryDispatcher(svc, &delays)
+
+	acked := []error{}
+	route := config.Route{Group: "/apigee/retry", Stream: "apigee"}
+
+	dispatcher.dispatchRoute(route, newRetryEntries(&acked))
+
+	require.Len(t, svc.inputs, 1)
+	require.Equal(t, []error{nil}, acked)
+	require.Equal(t, "5678", dispatcher.sequenceTokens[route])
+}
+
+func TestDispatchRouteFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cwlogs")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	sink, err := deadletter.NewFileSink(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	defer sink.Close()
+
+	route := config.Route{Group: "/apigee/retry", Stream: "apigee"}
+
+	// non retriable errors are dead lettered straight away
+	svc := &fakeLogs{errs: []error{awserr.New(cloudwatchlogs.ErrCodeResourceNotFoundException, "missing", nil)}}
+
+	delays := []time.Duration{}
+	dispatcher := newRetryDispatcher(svc, &delays)
+	dispatcher.deadLetter = sink
+
+	acked := []error{}
+	dispatcher.dispatchRoute(route, newRetryEntries(&acked))
+
+	require.Len(t, svc.inputs, 1)
+	require.Len(t, delays, 0)
+	require.Equal(t, []error{nil}, acked)
+
+	// retriable errors are dead lettered once the retry timeout passes
+	throttled := awserr.New("ThrottlingException", "Rate exceeded", nil)
+	svc = &fakeLogs{errs: []error{throttled, throttled, throttled, throttled, throttled}}
+
+	dispatcher = newRetryDispatcher(svc, &delays)
+	dispatcher.config.RetryTimeout = 0
+	dispatcher.deadLetter = sink
+
+	dispatcher.dispatchRoute(route, newRetryEntries(&acked))
+
+	require.Len(t, svc.inputs, 1)
+	require.Equal(t, []error{nil, nil}, acked)
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "deadletter.log"))
+	require.Nil(t, err)
+	require.Contains(t, string(data), `"reason":"put_failed"`)
+	require.Contains(t, string(data), `"reason":"retries_exhausted"`)
+
+	// without a dead letter sink entries are acknowledged with the error
+	svc = &fakeLogs{errs: []error{throttled}}
+
+	dispatcher = newRetryDispatcher(svc, &delays)
+	dispatcher.config.RetryTimeout = 0
+
+	acked = []error{}
+	dispatcher.dispatchRoute(route, newRetryEntries(&acked))
+
+	require.Len(t, acked, 1)
+	require.NotNil(t, acked[0])
+	require.Equal(t, "", dispatcher.sequenceTokens[route])
+}
+
+func TestBackoff(t *testing.T) {
+	dispatcher := &Dispatcher{config: &config.SyslogConfig{
+		RetryBaseDelay: 100 * time.Millisecond,
+		RetryMaxDelay:  time.Second,
+	}}
+
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := dispatcher.backoff(attempt)
+		require.True(t, delay >= 0)
+		require.True(t, delay <= time.Second)
+	}
+
+	dispatcher.config.RetryBaseDelay = 0
+	require.Equal(t, time.Duration(0), dispatcher.backoff(3))
+}
+
+type netError struct{}
+
+func (e *netError) Error() string   { return "i/o timeout" }
+func (e *netError) Timeout() bool   { return true }
+func (e *netError) Temporary() bool { return true }
@@ -0,0 +1,94 @@
+package cwlogs
+
+import (
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/proxyproto"
+)
+
+// Router selects the cloudwatch group and stream for each log entry
+type Router struct {
+	defaultRoute config.Route
+	peers        map[string]config.Route
+	endpoints    map[string]config.Route
+}
+
+// routedEntries log entries which share a route
+type routedEntries struct {
+	route   config.Route
+	entries []*batching.LogEntry
+}
+
+// NewRouter create a new router from the configuration
+func NewRouter(conf *config.SyslogConfig) (*Router, error) {
+	peers, err := conf.PeerRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := conf.VPCEndpointRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Router{
+		defaultRoute: conf.DefaultRoute(),
+		peers:        peers,
+		endpoints:    endpoints,
+	}, nil
+}
+
+// Route returns the route for the log entry using the TLS peer name, then the VPC endpoint ID
+func (r *Router) Route(entry *batching.LogEntry) config.Route {
+	if peer, ok := entry.Parts["tls_peer"].(string); ok {
+		if route, ok := r.peers[peer]; ok {
+			return route
+		}
+	}
+
+	if endpoint, ok := entry.Parts[proxyproto.FieldVPCEndpointID].(string); ok {
+		if route, ok := r.endpoints[endpoint]; ok {
+			return route
+		}
+	}
+
+	return r.defaultRoute
+}
+
+// Routes returns all the routes entries may be sent to
+func (r *Router) Routes() []config.Route {
+	routes := []config.Route{r.defaultRoute}
+	seen := map[config.Route]bool{r.defaultRoute: true}
+
+	for _, routeMap := range []map[string]config.Route{r.peers, r.endpoints} {
+		for _, route := range routeMap {
+			if !seen[route] {
+				routes = append(routes, route)
+				seen[route] = true
+			}
+		}
+	}
+
+	return routes
+}
+
+// partition splits the entries by route, preserving their order
+func (r *Router) partition(entries []*batching.LogEntry) []*routedEntries {
+	batches := []*routedEntries{}
+	index := map[config.Route]*routedEntries{}
+
+	for _, entry := range entries {
+		route := r.Route(entry)
+
+		batch, ok := index[route]
+		if !ok {
+			batch = &routedEntries{route: route}
+			index[route] = batch
+			batches = append(batches, batch)
+		}
+
+		batch.entries = append(batch.entries, entry)
+	}
+
+	return batches
+}
@@ -0,0 +1,68 @@
+package cwlogs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func TestRouterPartition(t *testing.T) {
+
+	router, err := NewRouter(&config.SyslogConfig{
+		Group:  "/apigee/default",
+		Stream: "apigee",
+		Routes: []string{"team-a:/apigee/team-a:apigee"},
+	})
+	require.Nil(t, err)
+
+	le := []*batching.LogEntry{
+		{Parts: map[string]interface{}{"tls_peer": "team-a", "content": "1"}},
+		{Parts: map[string]interface{}{"tls_peer": "team-b", "content": "2"}},
+		{Parts: map[string]interface{}{"content": "3"}},
+		{Parts: map[string]interface{}{"tls_peer": "team-a", "content": "4"}},
+	}
+
+	batches := router.partition(le)
+
+	require.Len(t, batches, 2)
+	require.Equal(t, config.Route{Group: "/apigee/team-a", Stream: "apigee"}, batches[0].route)
+	require.Equal(t, []*batching.LogEntry{le[0], le[3]}, batches[0].entries)
+	require.Equal(t, config.Route{Group: "/apigee/default", Stream: "apigee"}, batches[1].route)
+	require.Equal(t, []*batching.LogEntry{le[1], le[2]}, batches[1].entries)
+}
+
+func TestRouterEndpointRoutes(t *testing.T) {
+
+	router, err := NewRouter(&config.SyslogConfig{
+		Group:          "/apigee/default",
+		Stream:         "apigee",
+		Routes:         []string{"team-a:/apigee/team-a:apigee"},
+		EndpointRoutes: []string{"vpce-1:/apigee/consumer-1:apigee"},
+	})
+	require.Nil(t, err)
+
+	// peer routes take precedence over endpoint routes
+	require.Equal(t, config.Route{Group: "/apigee/team-a", Stream: "apigee"},
+		router.Route(&batching.LogEntry{Parts: map[string]interface{}{"tls_peer": "team-a", "vpce_id": "vpce-1"}}))
+	require.Equal(t, config.Route{Group: "/apigee/consumer-1", Stream: "apigee"},
+		router.Route(&batching.LogEntry{Parts: map[string]interface{}{"tls_peer": "team-b", "vpce_id": "vpce-1"}}))
+	require.Equal(t, config.Route{Group: "/apigee/default", Stream: "apigee"},
+		router.Route(&batching.LogEntry{Parts: map[string]interface{}{"vpce_id": "vpce-2"}}))
+
+	require.Len(t, router.Routes(), 3)
+
+	_, err = NewRouter(&config.SyslogConfig{
+		EndpointRoutes: []string{"vpce-1:/apigee/consumer-1"},
+	})
+	require.Error(t, err)
+}
+
+func TestNewRouterInvalidRoute(t *testing.T) {
+
+	_, err := NewRouter(&config.SyslogConfig{
+		Routes: []string{"team-a:/apigee/team-a"},
+	})
+	require.Error(t, err)
+}
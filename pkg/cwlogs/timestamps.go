@@ -0,0 +1,162 @@
+package cwlogs
+
+import (
+	"expvar"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// FieldOriginalTimestamp holds the timestamp of events which have been clamped
+const FieldOriginalTimestamp = "original_timestamp"
+
+var (
+	timestampEvents = expvar.NewMap("timestamp_events")
+	rejectedEvents  = expvar.NewMap("rejected_events")
+)
+
+// applyTimestampPolicy clamp or drop the entries with timestamps outside the range cloudwatch accepts at the time
+func (d *Dispatcher) applyTimestampPolicy(route config.Route, entries []*batching.LogEntry, now time.Time) []*batching.LogEntry {
+	result := make([]*batching.LogEntry, 0, len(entries))
+
+	for _, entry := range entries {
+		if inWindow(entry.MilliTimestamp, now) {
+			result = append(result, entry)
+			continue
+		}
+
+		fields := logrus.Fields{
+			"group":     route.Group,
+			"stream":    route.Stream,
+			"timestamp": entry.MilliTimestamp,
+			"policy":    d.config.TimestampPolicy,
+		}
+
+		if d.config.TimestampPolicy == config.TimestampDrop {
+			timestampEvents.Add("dropped", 1)
+			logrus.WithFields(fields).Warn("event timestamp out of range")
+
+			// the event would be rejected again if it was retried
+			batching.AckEntries([]*batching.LogEntry{entry}, nil)
+			continue
+		}
+
+		ClampEntry(entry, now)
+
+		timestampEvents.Add("clamped", 1)
+		logrus.WithFields(fields).Warn("event timestamp out of range")
+
+		result = append(result, entry)
+	}
+
+	return result
+}
+
+// ClampEntry set the timestamp of the entry to the time it was received, or now if that's also out of
+// range, and keep the original in the original_timestamp field
+func ClampEntry(entry *batching.LogEntry, now time.Time) {
+	clamped := entry.Received
+	if clamped.IsZero() || !inWindow(batching.MilliTimestamp(clamped), now) {
+		clamped = now
+	}
+
+	original, ok := entry.Parts["timestamp"]
+	if !ok {
+		original = time.Unix(0, entry.MilliTimestamp*int64(time.Millisecond))
+	}
+
+	entry.Parts[FieldOriginalTimestamp] = original
+	entry.Parts["timestamp"] = clamped
+	entry.MilliTimestamp = batching.MilliTimestamp(clamped)
+
+	entry.Reset()
+}
+
+// inWindow returns true if cloudwatch accepts events with the timestamp at the time
+func inWindow(timestamp int64, now time.Time) bool {
+	oldest := batching.MilliTimestamp(now.Add(-batching.MaxEventAge))
+	newest := batching.MilliTimestamp(now.Add(batching.MaxEventFuture))
+
+	return timestamp >= oldest && timestamp <= newest
+}
+
+// sortEntries sort the entries chronologically as required by PutLogEvents, preserving the order of
+// entries with the same timestamp such as the parts of split events
+func sortEntries(entries []*batching.LogEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].MilliTimestamp < entries[j].MilliTimestamp
+	})
+}
+
+// rejectedEntries returns the entries cloudwatch rejected, keyed by the reason they were rejected, the
+// end indexes are exclusive and the start index inclusive
+func rejectedEntries(entries []*batching.LogEntry, info *cloudwatchlogs.RejectedLogEventsInfo) map[string][]*batching.LogEntry {
+	rejected := map[string][]*batching.LogEntry{}
+
+	if info == nil {
+		return rejected
+	}
+
+	tooOld := 0
+
+	if info.TooOldLogEventEndIndex != nil {
+		tooOld = clampIndex(*info.TooOldLogEventEndIndex, len(entries))
+		rejected["too_old"] = entries[:tooOld]
+	}
+	if info.ExpiredLogEventEndIndex != nil {
+		// expired events which are also too old are only reported as too old
+		expired := clampIndex(*info.ExpiredLogEventEndIndex, len(entries))
+		if expired > tooOld {
+			rejected["expired"] = entries[tooOld:expired]
+		}
+	}
+	if info.TooNewLogEventStartIndex != nil {
+		rejected["too_new"] = entries[clampIndex(*info.TooNewLogEventStartIndex, len(entries)):]
+	}
+
+	for reason, reasonEntries := range rejected {
+		if len(reasonEntries) == 0 {
+			delete(rejected, reason)
+		}
+	}
+
+	return rejected
+}
+
+func clampIndex(index int64, length int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > int64(length) {
+		return length
+	}
+
+	return int(index)
+}
+
+// handleRejected log and count the entries cloudwatch rejected, writing them to the dead letter sink if there is one
+func (d *Dispatcher) handleRejected(route config.Route, entries []*batching.LogEntry, info *cloudwatchlogs.RejectedLogEventsInfo) {
+	for reason, rejected := range rejectedEntries(entries, info) {
+		rejectedEvents.Add(reason, int64(len(rejected)))
+
+		logrus.WithFields(logrus.Fields{
+			"group":  route.Group,
+			"stream": route.Stream,
+			"reason": reason,
+			"events": len(rejected),
+		}).Warn("cloudwatch rejected log events")
+
+		if d.deadLetter == nil {
+			continue
+		}
+
+		err := d.deadLetter.Write(route, reason, rejected)
+		if err != nil {
+			logrus.WithError(err).WithField("reason", reason).Error("dead letter write failed")
+		}
+	}
+}
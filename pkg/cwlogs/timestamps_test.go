@@ -0,0 +1,123 @@
+package cwlogs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+func TestApplyTimestampPolicyClamp(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-15 * 24 * time.Hour)
+
+	dispatcher := &Dispatcher{config: &config.SyslogConfig{TimestampPolicy: config.TimestampClamp}}
+
+	entries := []*batching.LogEntry{
+		batching.NewLogEntry(format.LogParts{"content": "old", "timestamp": old}),
+		batching.NewLogEntry(format.LogParts{"content": "new", "timestamp": now.Add(3 * time.Hour)}),
+		batching.NewLogEntry(format.LogParts{"content": "ok", "timestamp": now.Add(-time.Hour)}),
+	}
+
+	// the encoding is cached before the entry is clamped
+	_, err := entries[0].Encoded()
+	require.Nil(t, err)
+
+	result := dispatcher.applyTimestampPolicy(config.Route{}, entries, now)
+	require.Len(t, result, 3)
+
+	require.Equal(t, batching.MilliTimestamp(entries[0].Received), result[0].MilliTimestamp)
+	require.Equal(t, old, result[0].Parts[FieldOriginalTimestamp])
+	require.Equal(t, entries[0].Received, result[0].Parts["timestamp"])
+
+	data, err := result[0].Encoded()
+	require.Nil(t, err)
+	require.Contains(t, string(data), FieldOriginalTimestamp)
+
+	require.Equal(t, batching.MilliTimestamp(entries[1].Received), result[1].MilliTimestamp)
+
+	require.Equal(t, batching.MilliTimestamp(now.Add(-time.Hour)), result[2].MilliTimestamp)
+	require.NotContains(t, result[2].Parts, FieldOriginalTimestamp)
+}
+
+func TestClampEntryReceivedOutOfRange(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-20 * 24 * time.Hour)
+
+	// entries received long ago, for example from a queue, are clamped to now
+	entry := &batching.LogEntry{
+		Parts:          format.LogParts{"content": "old"},
+		MilliTimestamp: batching.MilliTimestamp(old),
+		Received:       old,
+	}
+
+	ClampEntry(entry, now)
+
+	require.Equal(t, batching.MilliTimestamp(now), entry.MilliTimestamp)
+	require.Equal(t, batching.MilliTimestamp(old), batching.MilliTimestamp(entry.Parts[FieldOriginalTimestamp].(time.Time)))
+}
+
+func TestApplyTimestampPolicyDrop(t *testing.T) {
+	now := time.Now()
+
+	dispatcher := &Dispatcher{config: &config.SyslogConfig{TimestampPolicy: config.TimestampDrop}}
+
+	acked := []error{}
+
+	entries := []*batching.LogEntry{
+		batching.NewLogEntry(format.LogParts{"content": "old", "timestamp": now.Add(-15 * 24 * time.Hour)}),
+		batching.NewLogEntry(format.LogParts{"content": "ok", "timestamp": now}),
+	}
+	entries[0].Ack = func(err error) { acked = append(acked, err) }
+
+	result := dispatcher.applyTimestampPolicy(config.Route{}, entries, now)
+	require.Len(t, result, 1)
+	require.Equal(t, "ok", result[0].Message)
+	require.Equal(t, []error{nil}, acked)
+}
+
+func TestSortEntries(t *testing.T) {
+	entries := []*batching.LogEntry{
+		{Message: "3", MilliTimestamp: 3},
+		{Message: "1a", MilliTimestamp: 1},
+		{Message: "2", MilliTimestamp: 2},
+		{Message: "1b", MilliTimestamp: 1},
+	}
+
+	sortEntries(entries)
+
+	messages := []string{}
+	for _, entry := range entries {
+		messages = append(messages, entry.Message)
+	}
+
+	require.Equal(t, []string{"1a", "1b", "2", "3"}, messages)
+}
+
+func TestRejectedEntries(t *testing.T) {
+	entries := []*batching.LogEntry{{Message: "0"}, {Message: "1"}, {Message: "2"}, {Message: "3"}, {Message: "4"}}
+
+	require.Empty(t, rejectedEntries(entries, nil))
+
+	rejected := rejectedEntries(entries, &cloudwatchlogs.RejectedLogEventsInfo{
+		TooOldLogEventEndIndex:   aws.Int64(1),
+		ExpiredLogEventEndIndex:  aws.Int64(2),
+		TooNewLogEventStartIndex: aws.Int64(4),
+	})
+
+	require.Equal(t, map[string][]*batching.LogEntry{
+		"too_old": entries[:1],
+		"expired": entries[1:2],
+		"too_new": entries[4:],
+	}, rejected)
+
+	rejected = rejectedEntries(entries, &cloudwatchlogs.RejectedLogEventsInfo{
+		TooNewLogEventStartIndex: aws.Int64(10),
+	})
+	require.Empty(t, rejected)
+}
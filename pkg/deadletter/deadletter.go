@@ -0,0 +1,98 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"expvar"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+var deadLetterEvents = expvar.NewMap("dead_letter_events")
+
+// Sink receives entries which couldn't be uploaded to their destination
+type Sink interface {
+	Write(route config.Route, reason string, entries []*batching.LogEntry) error
+}
+
+// Record a dead letter entry with the destination it couldn't be uploaded to and why
+type Record struct {
+	Group     string          `json:"group"`
+	Stream    string          `json:"stream"`
+	Reason    string          `json:"reason"`
+	Timestamp int64           `json:"timestamp"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// FileSink appends entries to a file as JSON lines
+type FileSink struct {
+	file *os.File
+	lock sync.Mutex
+}
+
+// NewFileSink open the file for appending, creating it and its directory if they don't exist, such as
+// when the file is in a spool directory which has yet to be created
+func NewFileSink(path string) (*FileSink, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create dead letter directory")
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open dead letter file")
+	}
+
+	return &FileSink{file: file}, nil
+}
+
+// Write append a record for each entry, the file is synced before returning
+func (s *FileSink) Write(route config.Route, reason string, entries []*batching.LogEntry) error {
+	buf := []byte{}
+
+	for _, entry := range entries {
+		event, err := entry.Encoded()
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal log entry into json")
+		}
+
+		data, err := json.Marshal(&Record{
+			Group:     route.Group,
+			Stream:    route.Stream,
+			Reason:    reason,
+			Timestamp: entry.MilliTimestamp,
+			Event:     event,
+		})
+		if err != nil {
+			return errors.Wrap(err, "unable to marshal dead letter record into json")
+		}
+
+		buf = append(append(buf, data...), '\n')
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := s.file.Write(buf)
+	if err != nil {
+		return errors.Wrap(err, "failed to write dead letter file")
+	}
+
+	err = s.file.Sync()
+	if err != nil {
+		return errors.Wrap(err, "failed to sync dead letter file")
+	}
+
+	deadLetterEvents.Add(reason, int64(len(entries)))
+
+	return nil
+}
+
+// Close close the file
+func (s *FileSink) Close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,81 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func Test_WhenFileSinkWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// the directory is created if it doesn't exist
+	path := filepath.Join(dir, "spool", "deadletter.log")
+
+	sink, err := NewFileSink(path)
+	require.Nil(t, err)
+
+	route := config.Route{Group: "/apigee/default", Stream: "apigee"}
+
+	err = sink.Write(route, "oversize", []*batching.LogEntry{
+		{Parts: map[string]interface{}{"content": "1"}, MilliTimestamp: 1000},
+		{Parts: map[string]interface{}{"content": "2"}, MilliTimestamp: 2000},
+	})
+	require.Nil(t, err)
+	require.Nil(t, sink.Close())
+
+	// records are appended when the file is reopened
+	sink, err = NewFileSink(path)
+	require.Nil(t, err)
+	defer sink.Close()
+
+	err = sink.Write(route, "rejected", []*batching.LogEntry{
+		{Parts: map[string]interface{}{"content": "3"}, MilliTimestamp: 3000},
+	})
+	require.Nil(t, err)
+
+	records := readRecords(t, path)
+	require.Len(t, records, 3)
+
+	require.Equal(t, "/apigee/default", records[0].Group)
+	require.Equal(t, "apigee", records[0].Stream)
+	require.Equal(t, "oversize", records[0].Reason)
+	require.Equal(t, int64(1000), records[0].Timestamp)
+	require.JSONEq(t, `{"content":"1"}`, string(records[0].Event))
+	require.Equal(t, "rejected", records[2].Reason)
+}
+
+func Test_WhenFileSinkWriteFails(t *testing.T) {
+	sink := &FileSink{}
+
+	err := sink.Write(config.Route{}, "oversize", []*batching.LogEntry{
+		{Parts: map[string]interface{}{"content": make(chan int)}},
+	})
+	require.Error(t, err)
+}
+
+func readRecords(t *testing.T, path string) []*Record {
+	file, err := os.Open(path)
+	require.Nil(t, err)
+	defer file.Close()
+
+	records := []*Record{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := &Record{}
+		require.Nil(t, json.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+
+	return records
+}
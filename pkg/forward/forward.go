@@ -0,0 +1,193 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+// Message a decoded forward protocol message containing one or more events
+type Message struct {
+	Tag    string
+	Events []format.LogParts
+	// chunk id which must be acknowledged, empty if the sender doesn't require an ack
+	Chunk string
+}
+
+// Decode decode a forward protocol message in Message, Forward, PackedForward or CompressedPackedForward
+// mode, the decompressed events of a CompressedPackedForward message are also limited to maxSize bytes
+func Decode(value interface{}, maxSize int) (*Message, error) {
+	fields, ok := value.([]interface{})
+	if !ok || len(fields) < 2 {
+		return nil, errors.New("forward message must be an array")
+	}
+
+	tag, ok := fields[0].(string)
+	if !ok {
+		return nil, errors.New("forward message tag must be a string")
+	}
+
+	msg := &Message{Tag: tag}
+
+	var (
+		options map[string]interface{}
+		err     error
+	)
+
+	switch entries := fields[1].(type) {
+	case []interface{}:
+		// Forward mode, [tag, [[time, record], ...], option]
+		options, err = optionsAt(fields, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			err = msg.addEntry(entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		// PackedForward and CompressedPackedForward modes, [tag, entries, option]
+		options, err = optionsAt(fields, 2)
+		if err != nil {
+			return nil, err
+		}
+
+		var reader io.Reader = bytes.NewReader([]byte(entries))
+
+		if options["compressed"] == "gzip" {
+			reader, err = gzip.NewReader(reader)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to decompress forward entries")
+			}
+		}
+
+		err = msg.addPackedEntries(reader, maxSize)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		// Message mode, [tag, time, record, option]
+		if len(fields) < 3 {
+			return nil, errors.New("forward message is missing its record")
+		}
+
+		options, err = optionsAt(fields, 3)
+		if err != nil {
+			return nil, err
+		}
+
+		err = msg.addEntry(fields[1:3])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if chunk, ok := options["chunk"].(string); ok {
+		msg.Chunk = chunk
+	}
+
+	return msg, nil
+}
+
+// addPackedEntries decode a stream of [time, record] entries
+func (msg *Message) addPackedEntries(reader io.Reader, maxSize int) error {
+	limited := &io.LimitedReader{R: reader, N: int64(maxSize) + 1}
+	dec := newDecoder(limited)
+
+	for {
+		entry, err := dec.Decode(maxSize)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to decode packed forward entries")
+		}
+
+		err = msg.addEntry(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if limited.N <= 0 {
+		return ErrTooLarge
+	}
+
+	return nil
+}
+
+// addEntry add an event from a [time, record] entry
+func (msg *Message) addEntry(value interface{}) error {
+	entry, ok := value.([]interface{})
+	if !ok || len(entry) != 2 {
+		return errors.New("forward entry must be an array of time and record")
+	}
+
+	timestamp, err := parseTime(entry[0])
+	if err != nil {
+		return err
+	}
+
+	record, ok := entry[1].(map[string]interface{})
+	if !ok {
+		return errors.New("forward record must be a map")
+	}
+
+	logParts := format.LogParts{}
+
+	for key, value := range record {
+		logParts[key] = value
+	}
+
+	logParts["tag"] = msg.Tag
+	logParts["timestamp"] = timestamp
+
+	// docker and fluent bit tail inputs use log, other inputs commonly use message
+	if _, ok := logParts["content"]; !ok {
+		for _, field := range []string{"log", "message"} {
+			if content, ok := record[field].(string); ok {
+				logParts["content"] = content
+				break
+			}
+		}
+	}
+
+	msg.Events = append(msg.Events, logParts)
+
+	return nil
+}
+
+// parseTime parse an EventTime or integer seconds since the epoch
+func parseTime(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case int64:
+		return time.Unix(v, 0), nil
+	case float64:
+		return time.Unix(0, int64(v*float64(time.Second))), nil
+	}
+
+	return time.Time{}, fmt.Errorf("forward event time %v is invalid", value)
+}
+
+func optionsAt(fields []interface{}, n int) (map[string]interface{}, error) {
+	if len(fields) <= n || fields[n] == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	options, ok := fields[n].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("forward message options must be a map")
+	}
+
+	return options, nil
+}
@@ -0,0 +1,85 @@
+package forward
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testTime = time.Unix(1519900200, 500)
+
+func testEntries(logs ...string) []interface{} {
+	entries := []interface{}{}
+
+	for _, log := range logs {
+		entries = append(entries, []interface{}{testTime, map[string]interface{}{"log": log, "stream": "stdout"}})
+	}
+
+	return entries
+}
+
+func Test_WhenDecodeMessageMode(t *testing.T) {
+	msg, err := Decode([]interface{}{"app", int64(1519900200), map[string]interface{}{"message": "hello"}}, 1024)
+	require.Nil(t, err)
+
+	require.Equal(t, "app", msg.Tag)
+	require.Equal(t, "", msg.Chunk)
+	require.Len(t, msg.Events, 1)
+	require.Equal(t, "hello", msg.Events[0]["content"])
+	require.Equal(t, "app", msg.Events[0]["tag"])
+	require.Equal(t, time.Unix(1519900200, 0), msg.Events[0]["timestamp"])
+}
+
+func Test_WhenDecodeForwardMode(t *testing.T) {
+	msg, err := Decode([]interface{}{"app", testEntries("one", "two"), map[string]interface{}{"chunk": "abc"}}, 1024)
+	require.Nil(t, err)
+
+	require.Equal(t, "abc", msg.Chunk)
+	require.Len(t, msg.Events, 2)
+	require.Equal(t, "two", msg.Events[1]["content"])
+	require.Equal(t, "stdout", msg.Events[1]["stream"])
+	require.Equal(t, testTime, msg.Events[1]["timestamp"])
+}
+
+func Test_WhenDecodePackedForwardMode(t *testing.T) {
+	packed := []byte{}
+	for _, entry := range testEntries("one", "two", "three") {
+		packed = encode(packed, entry)
+	}
+
+	msg, err := Decode([]interface{}{"app", string(packed)}, 1024)
+	require.Nil(t, err)
+	require.Len(t, msg.Events, 3)
+	require.Equal(t, "three", msg.Events[2]["content"])
+
+	compressed := &bytes.Buffer{}
+	gw := gzip.NewWriter(compressed)
+	gw.Write(packed)
+	gw.Close()
+
+	msg, err = Decode([]interface{}{"app", compressed.String(), map[string]interface{}{"compressed": "gzip", "chunk": "abc"}}, 1024)
+	require.Nil(t, err)
+	require.Len(t, msg.Events, 3)
+	require.Equal(t, "abc", msg.Chunk)
+
+	_, err = Decode([]interface{}{"app", compressed.String(), map[string]interface{}{"compressed": "gzip"}}, 50)
+	require.Error(t, err)
+}
+
+func Test_WhenDecodeInvalid(t *testing.T) {
+	for _, value := range []interface{}{
+		"app",
+		[]interface{}{"app"},
+		[]interface{}{int64(1), testEntries("one")},
+		[]interface{}{"app", int64(1)},
+		[]interface{}{"app", "time", map[string]interface{}{}},
+		[]interface{}{"app", []interface{}{[]interface{}{testTime, "record"}}},
+		[]interface{}{"app", testEntries("one"), "options"},
+	} {
+		_, err := Decode(value, 1024)
+		require.Error(t, err, "%v", value)
+	}
+}
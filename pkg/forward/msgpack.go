@@ -0,0 +1,296 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// extension type used by fluentd for timestamps with nanosecond precision
+const eventTimeExtType = 0
+
+// maxDepth the deepest nesting of arrays and maps decoded, the forward protocol only needs a few levels
+const maxDepth = 100
+
+var (
+	// ErrTooLarge returned when a message exceeds the maximum size
+	ErrTooLarge = errors.New("forward message exceeds maximum size")
+
+	// ErrTooDeep returned when a message nests arrays and maps deeper than the maximum depth
+	ErrTooDeep = errors.New("forward message exceeds maximum depth")
+)
+
+// decoder a minimal MessagePack decoder for the types used by the forward protocol, maps are
+// decoded as map[string]interface{}, str and bin as string and EventTime as time.Time
+type decoder struct {
+	r *bufio.Reader
+	// bytes remaining before the message exceeds the maximum size
+	remaining int
+	// arrays and maps currently being decoded
+	depth int
+}
+
+func newDecoder(r io.Reader) *decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &decoder{r: br}
+}
+
+// Decode decode the next value, limited to maxSize bytes
+func (d *decoder) Decode(maxSize int) (interface{}, error) {
+	d.remaining = maxSize
+	d.depth = 0
+
+	return d.decode()
+}
+
+func (d *decoder) decode() (interface{}, error) {
+	c, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.decodeMap(int(c & 0x0f))
+	case c&0xf0 == 0x90:
+		return d.decodeArray(int(c & 0x0f))
+	case c&0xe0 == 0xa0:
+		return d.decodeString(int(c & 0x1f))
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9:
+		return d.decodeString(d.readLength(1))
+	case 0xc5, 0xda:
+		return d.decodeString(d.readLength(2))
+	case 0xc6, 0xdb:
+		return d.decodeString(d.readLength(4))
+	case 0xc7:
+		return d.decodeExt(d.readLength(1))
+	case 0xc8:
+		return d.decodeExt(d.readLength(2))
+	case 0xc9:
+		return d.decodeExt(d.readLength(4))
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return float64(v), err
+		}
+		return int64(v), err
+	case 0xd0:
+		v, err := d.readUint(1)
+		return int64(int8(v)), err
+	case 0xd1:
+		v, err := d.readUint(2)
+		return int64(int16(v)), err
+	case 0xd2:
+		v, err := d.readUint(4)
+		return int64(int32(v)), err
+	case 0xd3:
+		v, err := d.readUint(8)
+		return int64(v), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (c - 0xd4))
+	case 0xdc:
+		return d.decodeArray(d.readLength(2))
+	case 0xdd:
+		return d.decodeArray(d.readLength(4))
+	case 0xde:
+		return d.decodeMap(d.readLength(2))
+	case 0xdf:
+		return d.decodeMap(d.readLength(4))
+	}
+
+	return nil, fmt.Errorf("unsupported MessagePack type 0x%x", c)
+}
+
+func (d *decoder) decodeArray(length int) (interface{}, error) {
+	// every element is at least one byte
+	if length < 0 || length > d.remaining {
+		return nil, ErrTooLarge
+	}
+
+	err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	values := make([]interface{}, length)
+
+	for n := range values {
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		values[n] = value
+	}
+
+	return values, nil
+}
+
+func (d *decoder) decodeMap(length int) (interface{}, error) {
+	if length < 0 || length*2 > d.remaining {
+		return nil, ErrTooLarge
+	}
+
+	err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	values := make(map[string]interface{}, length)
+
+	for n := 0; n < length; n++ {
+		key, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+
+		values[fmt.Sprint(key)] = value
+	}
+
+	return values, nil
+}
+
+// enter track decoding a nested array or map, returning an error past the maximum depth
+func (d *decoder) enter() error {
+	if d.depth >= maxDepth {
+		return ErrTooDeep
+	}
+
+	d.depth++
+
+	return nil
+}
+
+func (d *decoder) leave() {
+	d.depth--
+}
+
+func (d *decoder) decodeString(length int) (interface{}, error) {
+	data, err := d.readBytes(length)
+	return string(data), err
+}
+
+func (d *decoder) decodeExt(length int) (interface{}, error) {
+	extType, err := d.readByte()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.readBytes(length)
+	if err != nil {
+		return nil, err
+	}
+
+	if extType == eventTimeExtType && len(data) == 8 {
+		seconds := binary.BigEndian.Uint32(data[:4])
+		nanos := binary.BigEndian.Uint32(data[4:])
+
+		return time.Unix(int64(seconds), int64(nanos)), nil
+	}
+
+	return data, nil
+}
+
+// readLength read a big endian length, returning -1 on error which is rejected by the caller
+func (d *decoder) readLength(size int) int {
+	v, err := d.readUint(size)
+	if err != nil || v > math.MaxInt32 {
+		return -1
+	}
+
+	return int(v)
+}
+
+func (d *decoder) readUint(size int) (uint64, error) {
+	data, err := d.readBytes(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+
+	return v, nil
+}
+
+func (d *decoder) readByte() (byte, error) {
+	if d.remaining < 1 {
+		return 0, ErrTooLarge
+	}
+
+	d.remaining--
+
+	return d.r.ReadByte()
+}
+
+func (d *decoder) readBytes(length int) ([]byte, error) {
+	if length < 0 || length > d.remaining {
+		return nil, ErrTooLarge
+	}
+
+	d.remaining -= length
+
+	data := make([]byte, length)
+
+	_, err := io.ReadFull(d.r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return data, err
+}
+
+// encodeAck encode the response acknowledging a chunk, {"ack": chunk}
+func encodeAck(chunk string) []byte {
+	data := []byte{0x81, 0xa3, 'a', 'c', 'k'}
+
+	switch length := len(chunk); {
+	case length < 32:
+		data = append(data, 0xa0|byte(length))
+	case length < 1<<8:
+		data = append(data, 0xd9, byte(length))
+	case length < 1<<16:
+		data = append(data, 0xda, byte(length>>8), byte(length))
+	default:
+		data = append(data, 0xdb, byte(length>>24), byte(length>>16), byte(length>>8), byte(length))
+	}
+
+	return append(data, chunk...)
+}
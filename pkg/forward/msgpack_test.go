@@ -0,0 +1,127 @@
+package forward
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenDecodeMessagePack(t *testing.T) {
+	eventTime := time.Unix(1519900200, 123456789)
+
+	data := encode(nil, []interface{}{
+		"tag", int64(1), int64(-5), int64(300), int64(-70000), float64(1.5), true, nil,
+		map[string]interface{}{"log": "hello"}, []byte("bin"), eventTime,
+	})
+
+	value, err := newDecoder(bytes.NewReader(data)).Decode(1024)
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{
+		"tag", int64(1), int64(-5), int64(300), int64(-70000), float64(1.5), true, nil,
+		map[string]interface{}{"log": "hello"}, "bin", eventTime,
+	}, value)
+}
+
+func Test_WhenDecodeMessagePackTooLarge(t *testing.T) {
+	data := encode(nil, []interface{}{"tag", "a long string value"})
+
+	_, err := newDecoder(bytes.NewReader(data)).Decode(10)
+	require.Equal(t, ErrTooLarge, err)
+
+	// lengths are checked before they are allocated
+	_, err = newDecoder(bytes.NewReader([]byte{0xdd, 0xff, 0xff, 0xff, 0xff})).Decode(1024)
+	require.Equal(t, ErrTooLarge, err)
+}
+
+func Test_WhenDecodeMessagePackTooDeep(t *testing.T) {
+	// arrays of one element nested to the maximum depth
+	data := append(bytes.Repeat([]byte{0x91}, maxDepth), 0x01)
+
+	_, err := newDecoder(bytes.NewReader(data)).Decode(1024)
+	require.Nil(t, err)
+
+	data = append(bytes.Repeat([]byte{0x91}, 10000), 0x01)
+
+	_, err = newDecoder(bytes.NewReader(data)).Decode(100000)
+	require.Equal(t, ErrTooDeep, err)
+
+	data = append(bytes.Repeat([]byte{0x81, 0xa1, 'a'}, maxDepth+1), 0x01)
+
+	_, err = newDecoder(bytes.NewReader(data)).Decode(1024)
+	require.Equal(t, ErrTooDeep, err)
+}
+
+func Test_WhenEncodeAck(t *testing.T) {
+	value, err := newDecoder(bytes.NewReader(encodeAck("chunk-id"))).Decode(1024)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"ack": "chunk-id"}, value)
+
+	chunk := string(bytes.Repeat([]byte("a"), 300))
+
+	value, err = newDecoder(bytes.NewReader(encodeAck(chunk))).Decode(1024)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"ack": chunk}, value)
+}
+
+// encode a minimal MessagePack encoder used to build test messages
+func encode(data []byte, value interface{}) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(data, 0xc0)
+	case bool:
+		if v {
+			return append(data, 0xc3)
+		}
+		return append(data, 0xc2)
+	case int64:
+		return append(append(data, 0xd3), uint64Bytes(uint64(v))...)
+	case float64:
+		return append(append(data, 0xcb), uint64Bytes(math.Float64bits(v))...)
+	case string:
+		data = append(data, 0xdb)
+		data = append(data, uint64Bytes(uint64(len(v)))[4:]...)
+		return append(data, v...)
+	case []byte:
+		data = append(data, 0xc6)
+		data = append(data, uint64Bytes(uint64(len(v)))[4:]...)
+		return append(data, v...)
+	case time.Time:
+		data = append(data, 0xd7, eventTimeExtType)
+		data = append(data, uint64Bytes(uint64(v.Unix()))[4:]...)
+		return append(data, uint64Bytes(uint64(v.Nanosecond()))[4:]...)
+	case []interface{}:
+		data = append(data, 0xdd)
+		data = append(data, uint64Bytes(uint64(len(v)))[4:]...)
+		for _, item := range v {
+			data = encode(data, item)
+		}
+		return data
+	case map[string]interface{}:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		data = append(data, 0xdf)
+		data = append(data, uint64Bytes(uint64(len(v)))[4:]...)
+		for _, key := range keys {
+			data = encode(encode(data, key), v[key])
+		}
+		return data
+	}
+
+	panic("unsupported type")
+}
+
+func uint64Bytes(v uint64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, v)
+
+	return data
+}
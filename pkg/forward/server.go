@@ -0,0 +1,188 @@
+package forward
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// DefaultMaxSize used when the listener doesn't configure a limit on the size of each message
+const DefaultMaxSize = 1048576
+
+var forwardErrors = expvar.NewMap("forward_errors")
+
+// Submitter accepts log entries, blocking until they are queued
+type Submitter interface {
+	Submit(entries ...*batching.LogEntry)
+}
+
+// Server accepts fluentd forward protocol connections, messages requesting an ack are acknowledged
+// once their events have been accepted by the submitter, or delivered when the listener is in delivered mode
+type Server struct {
+	lc        *config.ListenerConfig
+	listener  net.Listener
+	submitter Submitter
+	maxSize   int
+	wait      sync.WaitGroup
+}
+
+// NewServer create a new forward server accepting connections from the listener
+func NewServer(lc *config.ListenerConfig, listener net.Listener, submitter Submitter) *Server {
+	maxSize := int(lc.MaxBodySize)
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+
+	return &Server{
+		lc:        lc,
+		listener:  listener,
+		submitter: submitter,
+		maxSize:   maxSize,
+	}
+}
+
+// Boot start accepting connections
+func (s *Server) Boot() error {
+	if s.listener == nil {
+		return errors.New("forward server has no listener")
+	}
+
+	s.wait.Add(1)
+
+	go s.accept()
+
+	return nil
+}
+
+// Wait wait until the server stops accepting connections
+func (s *Server) Wait() {
+	s.wait.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wait.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("forward accept failed")
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	fc := &connection{server: s, conn: conn, client: conn.RemoteAddr().String()}
+
+	err := fc.run()
+	if err != nil && err != io.EOF {
+		forwardErrors.Add(s.lc.Name, 1)
+		logrus.WithError(err).WithFields(logrus.Fields{"listener": s.lc.Name, "client": fc.client}).Warn("forward connection failed")
+	}
+}
+
+// connection a single forward connection, acks may be written by the dispatcher
+// when messages are acknowledged on delivery so writes are serialised
+type connection struct {
+	server *Server
+	conn   net.Conn
+	client string
+	lock   sync.Mutex
+}
+
+func (fc *connection) run() error {
+	dec := newDecoder(fc.conn)
+
+	for {
+		value, err := dec.Decode(fc.server.maxSize)
+		if err != nil {
+			return err
+		}
+
+		msg, err := Decode(value, fc.server.maxSize)
+		if err != nil {
+			return err
+		}
+
+		fc.submit(msg)
+	}
+}
+
+// submit tag the events of the message with the client and submit them, acknowledging the chunk once accepted or delivered
+func (fc *connection) submit(msg *Message) {
+	lc := fc.server.lc
+
+	entries := make([]*batching.LogEntry, len(msg.Events))
+
+	for n, logParts := range msg.Events {
+		logParts["client"] = fc.client
+
+		entries[n] = batching.NewLogEntry(logParts)
+	}
+
+	if msg.Chunk != "" && lc.AckMode == config.AckModeDelivered && len(entries) > 0 {
+		ack := newChunkAck(len(entries), func() { fc.ack(msg.Chunk) })
+
+		for _, entry := range entries {
+			entry.Ack = ack.done
+		}
+
+		fc.server.submitter.Submit(entries...)
+
+		return
+	}
+
+	fc.server.submitter.Submit(entries...)
+
+	if msg.Chunk != "" {
+		fc.ack(msg.Chunk)
+	}
+}
+
+func (fc *connection) ack(chunk string) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	_, err := fc.conn.Write(encodeAck(chunk))
+	if err != nil {
+		logrus.WithError(err).WithField("client", fc.client).Debug("forward ack failed")
+	}
+}
+
+// chunkAck acknowledges a chunk once all of its events are delivered, if any event fails
+// the chunk isn't acknowledged so the sender retransmits it
+type chunkAck struct {
+	pending int
+	failed  bool
+	ack     func()
+	lock    sync.Mutex
+}
+
+func newChunkAck(pending int, ack func()) *chunkAck {
+	return &chunkAck{pending: pending, ack: ack}
+}
+
+func (c *chunkAck) done(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err != nil {
+		c.failed = true
+	}
+
+	c.pending--
+
+	if c.pending == 0 && !c.failed {
+		c.ack()
+	}
+}
@@ -0,0 +1,74 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+type testSubmitter struct {
+	entries chan *batching.LogEntry
+}
+
+func (s *testSubmitter) Submit(entries ...*batching.LogEntry) {
+	for _, entry := range entries {
+		s.entries <- entry
+	}
+}
+
+func Test_WhenServeAccepted(t *testing.T) {
+	submitter, conn, dec := testConnection(t, config.AckModeAccepted)
+	defer conn.Close()
+
+	_, err := conn.Write(encode(nil, []interface{}{"app", testEntries("one", "two"), map[string]interface{}{"chunk": "abc"}}))
+	require.Nil(t, err)
+
+	entry := <-submitter.entries
+	require.Equal(t, "one", entry.Message)
+	require.Equal(t, conn.LocalAddr().String(), entry.Parts["client"])
+	<-submitter.entries
+
+	value, err := dec.Decode(1024)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"ack": "abc"}, value)
+}
+
+func Test_WhenServeDelivered(t *testing.T) {
+	submitter, conn, dec := testConnection(t, config.AckModeDelivered)
+	defer conn.Close()
+
+	_, err := conn.Write(encode(nil, []interface{}{"app", testEntries("one", "two"), map[string]interface{}{"chunk": "abc"}}))
+	require.Nil(t, err)
+	_, err = conn.Write(encode(nil, []interface{}{"app", testEntries("three"), map[string]interface{}{"chunk": "def"}}))
+	require.Nil(t, err)
+
+	one, two, three := <-submitter.entries, <-submitter.entries, <-submitter.entries
+
+	// the first chunk isn't acknowledged as one of its events failed
+	batching.AckEntries([]*batching.LogEntry{one}, nil)
+	batching.AckEntries([]*batching.LogEntry{two}, fmt.Errorf("failed"))
+	batching.AckEntries([]*batching.LogEntry{three}, nil)
+
+	value, err := dec.Decode(1024)
+	require.Nil(t, err)
+	require.Equal(t, map[string]interface{}{"ack": "def"}, value)
+}
+
+func testConnection(t *testing.T, ackMode string) (*testSubmitter, net.Conn, *decoder) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	submitter := &testSubmitter{entries: make(chan *batching.LogEntry, 10)}
+	server := NewServer(&config.ListenerConfig{Name: "fluent", Transport: config.TransportForward, AckMode: ackMode}, ln, submitter)
+	require.Nil(t, server.Boot())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+
+	return submitter, conn, newDecoder(bufio.NewReader(conn))
+}
@@ -0,0 +1,174 @@
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	syslog "github.com/wolfeidau/go-syslog"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+// MaxFrameSize the largest frame which can be read, this is limited by the buffer used to scan connections
+const MaxFrameSize = bufio.MaxScanTokenSize
+
+var framingErrors = expvar.NewMap("framing_errors")
+
+var (
+	// ErrFrameTooLarge returned when a frame exceeds the maximum frame size
+	ErrFrameTooLarge = errors.New("frame exceeds maximum size")
+
+	// ErrInvalidLength returned when an octet counted frame has an invalid length
+	ErrInvalidLength = errors.New("invalid octet counted frame length")
+)
+
+// Format parses messages using the automatic syslog format detection and splits the
+// stream into messages using the configured framing
+type Format struct {
+	listener string
+	framing  string
+	maxSize  int
+}
+
+// NewFormat create a new format for the listener
+func NewFormat(lc *config.ListenerConfig) *Format {
+	maxSize := lc.MaxFrameSize
+	if maxSize <= 0 || maxSize > MaxFrameSize {
+		maxSize = MaxFrameSize
+	}
+
+	return &Format{
+		listener: lc.Name,
+		framing:  lc.Framing,
+		maxSize:  maxSize,
+	}
+}
+
+// GetParser returns a parser for the message
+func (f *Format) GetParser(line []byte) format.LogParser {
+	return syslog.Automatic.GetParser(line)
+}
+
+// GetSplitFunc returns the split function for the configured framing
+func (f *Format) GetSplitFunc() bufio.SplitFunc {
+	var split bufio.SplitFunc
+
+	switch f.framing {
+	case config.FramingOctetCounting:
+		split = f.splitOctetCounted
+	case config.FramingLF:
+		split = f.splitDelimited('\n')
+	case config.FramingNUL:
+		split = f.splitDelimited(0)
+	default:
+		split = f.splitAutomatic
+	}
+
+	return f.countErrors(split)
+}
+
+// splitAutomatic detects octet counted frames using the leading digit, otherwise splits on new lines
+func (f *Format) splitAutomatic(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) > 0 && data[0] >= '0' && data[0] <= '9' {
+		return f.splitOctetCounted(data, atEOF)
+	}
+
+	return f.splitDelimited('\n')(data, atEOF)
+}
+
+// splitOctetCounted splits frames in the form MSG-LEN SP SYSLOG-MSG as described in RFC 5425 and RFC 6587
+func (f *Format) splitOctetCounted(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	sp := bytes.IndexByte(data, ' ')
+	if sp == -1 {
+		// the length can't have more digits than the maximum frame size
+		if len(data) > len(strconv.Itoa(f.maxSize)) || atEOF {
+			return 0, nil, ErrInvalidLength
+		}
+
+		return 0, nil, nil
+	}
+
+	length, err := strconv.Atoi(string(data[:sp]))
+	if err != nil || length <= 0 {
+		return 0, nil, ErrInvalidLength
+	}
+
+	if sp+1+length > f.maxSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+
+	end := sp + 1 + length
+	if len(data) < end {
+		if atEOF {
+			return 0, nil, ErrInvalidLength
+		}
+
+		return 0, nil, nil
+	}
+
+	return end, data[sp+1 : end], nil
+}
+
+// splitDelimited splits frames terminated by the delimiter, a trailing carriage return is removed
+func (f *Format) splitDelimited(delimiter byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		if atEOF && len(data) == 0 {
+			return 0, nil, nil
+		}
+
+		if i := bytes.IndexByte(data, delimiter); i >= 0 {
+			if i+1 > f.maxSize {
+				return 0, nil, ErrFrameTooLarge
+			}
+
+			return i + 1, bytes.TrimSuffix(data[:i], []byte{'\r'}), nil
+		}
+
+		if len(data) >= f.maxSize {
+			return 0, nil, ErrFrameTooLarge
+		}
+
+		// a final frame without a delimiter
+		if atEOF {
+			return len(data), bytes.TrimSuffix(data, []byte{'\r'}), nil
+		}
+
+		return 0, nil, nil
+	}
+}
+
+// countErrors counts and logs framing errors, these end the connection
+func (f *Format) countErrors(split bufio.SplitFunc) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (advance int, token []byte, err error) {
+		advance, token, err = split(data, atEOF)
+		if err != nil {
+			framingErrors.Add(f.listener, 1)
+
+			logrus.WithError(err).WithFields(logrus.Fields{
+				"listener": f.listener,
+				"framing":  f.framing,
+				"buffered": len(data),
+				"preview":  fmt.Sprintf("%q", preview(data)),
+			}).Warn("framing error, closing connection")
+		}
+
+		return advance, token, err
+	}
+}
+
+func preview(data []byte) []byte {
+	if len(data) > 32 {
+		return data[:32]
+	}
+
+	return data
+}
@@ -0,0 +1,86 @@
+package framing
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func TestOctetCounting(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", Framing: config.FramingOctetCounting})
+
+	frames, err := scan(f, "11 hello\nworld5 abcde")
+	require.Nil(t, err)
+	require.Equal(t, []string{"hello\nworld", "abcde"}, frames)
+
+	_, err = scan(f, "abc hello")
+	require.Equal(t, ErrInvalidLength, err)
+
+	_, err = scan(f, "11 hello")
+	require.Equal(t, ErrInvalidLength, err)
+}
+
+func TestOctetCountingTooLarge(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", Framing: config.FramingOctetCounting, MaxFrameSize: 10})
+
+	frames, err := scan(f, "5 abcde100 ")
+	require.Equal(t, ErrFrameTooLarge, err)
+	require.Equal(t, []string{"abcde"}, frames)
+
+	_, err = scan(f, "123456789012345")
+	require.Equal(t, ErrInvalidLength, err)
+}
+
+func TestLF(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", Framing: config.FramingLF})
+
+	frames, err := scan(f, "hello\r\nworld\nabc")
+	require.Nil(t, err)
+	require.Equal(t, []string{"hello", "world", "abc"}, frames)
+}
+
+func TestNUL(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", Framing: config.FramingNUL})
+
+	frames, err := scan(f, "hello\nworld\x00abc\x00")
+	require.Nil(t, err)
+	require.Equal(t, []string{"hello\nworld", "abc"}, frames)
+}
+
+func TestDelimitedTooLarge(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", Framing: config.FramingLF, MaxFrameSize: 10})
+
+	frames, err := scan(f, "hello\n"+strings.Repeat("a", 20)+"\n")
+	require.Equal(t, ErrFrameTooLarge, err)
+	require.Equal(t, []string{"hello"}, frames)
+}
+
+func TestAutomatic(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test"})
+
+	frames, err := scan(f, "<34>1 hello\n11 hello\nworld<34>1 abc\n")
+	require.Nil(t, err)
+	require.Equal(t, []string{"<34>1 hello", "hello\nworld", "<34>1 abc"}, frames)
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	f := NewFormat(&config.ListenerConfig{Name: "test", MaxFrameSize: 1024 * 1024})
+
+	require.Equal(t, MaxFrameSize, f.maxSize)
+}
+
+func scan(f *Format, data string) ([]string, error) {
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	scanner.Split(f.GetSplitFunc())
+
+	frames := []string{}
+
+	for scanner.Scan() {
+		frames = append(frames, scanner.Text())
+	}
+
+	return frames, scanner.Err()
+}
@@ -0,0 +1,137 @@
+package gelf
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// chunk header is the magic bytes, an 8 byte message id, the sequence number and the sequence count
+const (
+	chunkHeaderSize = 12
+	maxChunks       = 128
+	maxChunkSize    = 8192
+)
+
+// MaxUDPMessageSize the largest message sent over UDP, the most which can be sent in the maximum number of chunks
+const MaxUDPMessageSize = maxChunks * maxChunkSize
+
+// ChunkTimeout how long the chunks of a message are kept waiting for the remaining chunks
+const ChunkTimeout = 5 * time.Second
+
+// MaxPendingMessages the number of incomplete messages kept waiting for their remaining chunks
+const MaxPendingMessages = 256
+
+var (
+	// ErrInvalidChunk returned when a chunk header is malformed
+	ErrInvalidChunk = errors.New("invalid GELF chunk")
+
+	// ErrTooManyPending returned when a chunk starts a new message while the maximum number of messages are incomplete
+	ErrTooManyPending = errors.New("too many incomplete GELF messages")
+)
+
+// IsChunked returns true if the datagram is a chunk of a larger message
+func IsChunked(data []byte) bool {
+	return bytes.HasPrefix(data, chunkedMagic)
+}
+
+// Assembler reassembles chunked messages, discarding incomplete messages after the timeout
+type Assembler struct {
+	timeout    time.Duration
+	maxSize    int
+	maxPending int
+	messages   map[string]*chunkedMessage
+	lock       sync.Mutex
+}
+
+type chunkedMessage struct {
+	chunks   [][]byte
+	received int
+	size     int
+	expires  time.Time
+}
+
+// NewAssembler create a new assembler limiting messages to maxSize bytes and the number of incomplete messages to maxPending
+func NewAssembler(timeout time.Duration, maxSize, maxPending int) *Assembler {
+	return &Assembler{
+		timeout:    timeout,
+		maxSize:    maxSize,
+		maxPending: maxPending,
+		messages:   map[string]*chunkedMessage{},
+	}
+}
+
+// Add add a chunk, returning the message once all of its chunks have been received
+func (a *Assembler) Add(data []byte, now time.Time) ([]byte, error) {
+	if len(data) < chunkHeaderSize || !IsChunked(data) {
+		return nil, ErrInvalidChunk
+	}
+
+	id := string(data[2:10])
+	seq, count := int(data[10]), int(data[11])
+
+	if count == 0 || count > maxChunks || seq >= count {
+		return nil, ErrInvalidChunk
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.expire(now)
+
+	msg, ok := a.messages[id]
+	if !ok {
+		if len(a.messages) >= a.maxPending {
+			return nil, ErrTooManyPending
+		}
+
+		msg = &chunkedMessage{chunks: make([][]byte, count), expires: now.Add(a.timeout)}
+		a.messages[id] = msg
+	}
+
+	if len(msg.chunks) != count {
+		delete(a.messages, id)
+		return nil, ErrInvalidChunk
+	}
+
+	// duplicate chunks are ignored
+	if msg.chunks[seq] != nil {
+		return nil, nil
+	}
+
+	chunk := data[chunkHeaderSize:]
+
+	msg.size += len(chunk)
+	if msg.size > a.maxSize {
+		delete(a.messages, id)
+		return nil, ErrMessageTooLarge
+	}
+
+	msg.chunks[seq] = append([]byte{}, chunk...)
+	msg.received++
+
+	if msg.received < count {
+		return nil, nil
+	}
+
+	delete(a.messages, id)
+
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// Pending returns the number of incomplete messages
+func (a *Assembler) Pending() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	return len(a.messages)
+}
+
+func (a *Assembler) expire(now time.Time) {
+	for id, msg := range a.messages {
+		if now.After(msg.expires) {
+			delete(a.messages, id)
+		}
+	}
+}
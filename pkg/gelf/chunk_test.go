@@ -0,0 +1,109 @@
+package gelf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenAssembleChunks(t *testing.T) {
+	assembler := NewAssembler(ChunkTimeout, 1024, MaxPendingMessages)
+	now := time.Now()
+
+	chunks := testChunks("msgid001", []byte(testMessage), 3)
+
+	message, err := assembler.Add(chunks[2], now)
+	require.Nil(t, err)
+	require.Nil(t, message)
+
+	// duplicates are ignored
+	message, err = assembler.Add(chunks[2], now)
+	require.Nil(t, err)
+	require.Nil(t, message)
+
+	message, err = assembler.Add(chunks[0], now)
+	require.Nil(t, err)
+	require.Nil(t, message)
+	require.Equal(t, 1, assembler.Pending())
+
+	message, err = assembler.Add(chunks[1], now)
+	require.Nil(t, err)
+	require.Equal(t, testMessage, string(message))
+	require.Equal(t, 0, assembler.Pending())
+}
+
+func Test_WhenChunksExpire(t *testing.T) {
+	assembler := NewAssembler(ChunkTimeout, 1024, MaxPendingMessages)
+	now := time.Now()
+
+	_, err := assembler.Add(testChunks("msgid001", []byte(testMessage), 2)[0], now)
+	require.Nil(t, err)
+
+	_, err = assembler.Add(testChunks("msgid002", []byte(testMessage), 2)[0], now.Add(2*ChunkTimeout))
+	require.Nil(t, err)
+	require.Equal(t, 1, assembler.Pending())
+}
+
+func Test_WhenChunksInvalid(t *testing.T) {
+	assembler := NewAssembler(ChunkTimeout, 100, MaxPendingMessages)
+
+	_, err := assembler.Add([]byte{0x1e, 0x0f, 1, 2}, time.Now())
+	require.Equal(t, ErrInvalidChunk, err)
+
+	chunk := testChunks("msgid001", []byte("abc"), 1)[0]
+	chunk[10] = 1
+
+	_, err = assembler.Add(chunk, time.Now())
+	require.Equal(t, ErrInvalidChunk, err)
+
+	chunks := testChunks("msgid002", []byte(testMessage), 2)
+
+	_, err = assembler.Add(chunks[0], time.Now())
+	require.Nil(t, err)
+	_, err = assembler.Add(chunks[1], time.Now())
+	require.Equal(t, ErrMessageTooLarge, err)
+	require.Equal(t, 0, assembler.Pending())
+}
+
+func Test_WhenTooManyPending(t *testing.T) {
+	assembler := NewAssembler(ChunkTimeout, 1024, 2)
+	now := time.Now()
+
+	_, err := assembler.Add(testChunks("msgid001", []byte(testMessage), 2)[0], now)
+	require.Nil(t, err)
+	_, err = assembler.Add(testChunks("msgid002", []byte(testMessage), 2)[0], now)
+	require.Nil(t, err)
+
+	_, err = assembler.Add(testChunks("msgid003", []byte(testMessage), 2)[0], now)
+	require.Equal(t, ErrTooManyPending, err)
+	require.Equal(t, 2, assembler.Pending())
+
+	// chunks of incomplete messages are still accepted
+	message, err := assembler.Add(testChunks("msgid001", []byte(testMessage), 2)[1], now)
+	require.Nil(t, err)
+	require.Equal(t, testMessage, string(message))
+
+	// once incomplete messages expire new messages are accepted
+	_, err = assembler.Add(testChunks("msgid003", []byte(testMessage), 2)[0], now.Add(2*ChunkTimeout))
+	require.Nil(t, err)
+	require.Equal(t, 1, assembler.Pending())
+}
+
+func testChunks(id string, data []byte, count int) [][]byte {
+	chunks := make([][]byte, count)
+	size := (len(data) + count - 1) / count
+
+	for n := 0; n < count; n++ {
+		end := (n + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+
+		chunk := append([]byte{0x1e, 0x0f}, []byte(id)...)
+		chunk = append(chunk, byte(n), byte(count))
+		chunks[n] = append(chunk, data[n*size:end]...)
+	}
+
+	return chunks
+}
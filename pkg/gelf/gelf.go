@@ -0,0 +1,157 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+// magic bytes identifying chunked and compressed messages
+var (
+	chunkedMagic = []byte{0x1e, 0x0f}
+	gzipMagic    = []byte{0x1f, 0x8b}
+)
+
+var (
+	// ErrMessageTooLarge returned when a message, once decompressed, exceeds the maximum size
+	ErrMessageTooLarge = errors.New("GELF message exceeds maximum size")
+
+	// ErrMissingShortMessage returned when a message doesn't contain the required short_message field
+	ErrMissingShortMessage = errors.New("GELF message is missing short_message")
+)
+
+// fields defined by the GELF specification mapped to the names used for syslog messages
+var fieldNames = map[string]string{
+	"short_message": "content",
+	"host":          "hostname",
+	"level":         "severity",
+	"facility":      "facility",
+	"full_message":  "full_message",
+	"line":          "line",
+	"file":          "file",
+}
+
+// Decompress returns the message, decompressing gzip and zlib messages, limited to maxSize bytes
+func Decompress(data []byte, maxSize int) ([]byte, error) {
+	var (
+		reader io.Reader
+		err    error
+	)
+
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		reader, err = gzip.NewReader(bytes.NewReader(data))
+	case isZlib(data):
+		reader, err = zlib.NewReader(bytes.NewReader(data))
+	default:
+		if len(data) > maxSize {
+			return nil, ErrMessageTooLarge
+		}
+		return data, nil
+	}
+
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress GELF message")
+	}
+
+	message, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress GELF message")
+	}
+
+	if len(message) > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	return message, nil
+}
+
+// Parse parse a GELF JSON message into log parts using the syslog field names, additional
+// fields are included without their leading underscore unless that clashes with another field
+func Parse(data []byte) (format.LogParts, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	var message map[string]interface{}
+
+	err := decoder.Decode(&message)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode GELF message")
+	}
+
+	if message == nil {
+		return nil, errors.New("GELF message is not a JSON object")
+	}
+
+	if _, ok := message["short_message"].(string); !ok {
+		return nil, ErrMissingShortMessage
+	}
+
+	logParts := format.LogParts{}
+
+	for key, value := range message {
+		if name, ok := fieldNames[key]; ok {
+			logParts[name] = value
+		}
+	}
+
+	logParts["timestamp"] = parseTimestamp(message["timestamp"])
+
+	if level, ok := message["level"].(json.Number); ok {
+		if severity, err := level.Int64(); err == nil {
+			logParts["severity"] = int(severity)
+		}
+	}
+
+	for key, value := range message {
+		if !strings.HasPrefix(key, "_") || key == "_id" {
+			continue
+		}
+
+		name := strings.TrimPrefix(key, "_")
+		if _, ok := logParts[name]; ok {
+			name = key
+		}
+
+		logParts[name] = value
+	}
+
+	return logParts, nil
+}
+
+// parseTimestamp GELF timestamps are seconds since the epoch with optional decimal milliseconds
+func parseTimestamp(value interface{}) time.Time {
+	number, ok := value.(json.Number)
+	if !ok {
+		return time.Now()
+	}
+
+	seconds, err := number.Float64()
+	if err != nil {
+		return time.Now()
+	}
+
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// isZlib zlib streams start with a deflate compression method and a header checksum
+func isZlib(data []byte) bool {
+	return len(data) >= 2 && data[0]&0x0f == 0x08 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0
+}
+
+func describe(data []byte) string {
+	if len(data) > 16 {
+		data = data[:16]
+	}
+
+	return fmt.Sprintf("%q", data)
+}
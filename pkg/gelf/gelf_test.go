@@ -0,0 +1,67 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testMessage = `{"version":"1.1","host":"docker01","short_message":"started","full_message":"started\ncontainer","timestamp":1519900200.5,"level":6,"_container_name":"web","_hostname":"web-1","_id":"abc"}`
+
+func Test_WhenParse(t *testing.T) {
+	logParts, err := Parse([]byte(testMessage))
+	require.Nil(t, err)
+
+	require.Equal(t, "started", logParts["content"])
+	require.Equal(t, "started\ncontainer", logParts["full_message"])
+	require.Equal(t, "docker01", logParts["hostname"])
+	require.Equal(t, 6, logParts["severity"])
+	require.Equal(t, "web", logParts["container_name"])
+	require.Equal(t, time.Unix(1519900200, 500000000), logParts["timestamp"])
+
+	// additional fields which clash keep their underscore, and _id isn't allowed
+	require.Equal(t, "web-1", logParts["_hostname"])
+	require.Nil(t, logParts["id"])
+	require.Nil(t, logParts["_id"])
+}
+
+func Test_WhenParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		`{"host":"docker01"}`,
+		`{"short_message":1}`,
+		`null`,
+		`[]`,
+		`{`,
+	} {
+		_, err := Parse([]byte(data))
+		require.Error(t, err, data)
+	}
+}
+
+func Test_WhenDecompress(t *testing.T) {
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(testMessage))
+	gw.Close()
+
+	zlibbed := &bytes.Buffer{}
+	zw := zlib.NewWriter(zlibbed)
+	zw.Write([]byte(testMessage))
+	zw.Close()
+
+	for _, data := range [][]byte{[]byte(testMessage), gzipped.Bytes(), zlibbed.Bytes()} {
+		message, err := Decompress(data, 1024)
+		require.Nil(t, err)
+		require.Equal(t, testMessage, string(message))
+	}
+
+	_, err := Decompress(gzipped.Bytes(), 100)
+	require.Equal(t, ErrMessageTooLarge, err)
+
+	_, err = Decompress([]byte(testMessage), 100)
+	require.Equal(t, ErrMessageTooLarge, err)
+}
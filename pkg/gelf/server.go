@@ -0,0 +1,205 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/framing"
+)
+
+// maxDatagramSize the largest UDP datagram which can be received
+const maxDatagramSize = 65536
+
+var gelfErrors = expvar.NewMap("gelf_errors")
+
+// Submitter accepts log entries, blocking until they are queued
+type Submitter interface {
+	Submit(entries ...*batching.LogEntry)
+}
+
+// Server receives GELF messages over TCP, where messages are terminated by a NUL, or UDP
+// where messages may be compressed and split into chunks
+type Server struct {
+	lc        *config.ListenerConfig
+	listener  net.Listener
+	conn      net.PacketConn
+	submitter Submitter
+	assembler *Assembler
+	maxSize   int
+	wait      sync.WaitGroup
+}
+
+// NewTCPServer create a new GELF server accepting connections from the listener
+func NewTCPServer(lc *config.ListenerConfig, listener net.Listener, submitter Submitter) *Server {
+	s := newServer(lc, submitter)
+	s.listener = listener
+
+	return s
+}
+
+// NewUDPServer create a new GELF server reading datagrams from the connection
+func NewUDPServer(lc *config.ListenerConfig, conn net.PacketConn, submitter Submitter) *Server {
+	s := newServer(lc, submitter)
+	s.conn = conn
+	// chunked messages can be larger than a frame
+	s.maxSize = MaxUDPMessageSize
+	s.assembler = NewAssembler(ChunkTimeout, s.maxSize, MaxPendingMessages)
+
+	return s
+}
+
+func newServer(lc *config.ListenerConfig, submitter Submitter) *Server {
+	maxSize := lc.MaxFrameSize
+	if maxSize <= 0 || maxSize > framing.MaxFrameSize {
+		maxSize = framing.MaxFrameSize
+	}
+
+	return &Server{
+		lc:        lc,
+		submitter: submitter,
+		maxSize:   maxSize,
+	}
+}
+
+// Boot start receiving messages
+func (s *Server) Boot() error {
+	switch {
+	case s.listener != nil:
+		s.wait.Add(1)
+		go s.accept()
+	case s.conn != nil:
+		s.wait.Add(1)
+		go s.receive()
+	default:
+		return errors.New("GELF server has no listener")
+	}
+
+	return nil
+}
+
+// Wait wait until the server stops receiving messages
+func (s *Server) Wait() {
+	s.wait.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wait.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("GELF accept failed")
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	client := conn.RemoteAddr().String()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), s.maxSize)
+	scanner.Split(splitNUL)
+
+	for scanner.Scan() {
+		// some senders also terminate messages with a new line
+		s.handle(bytes.TrimSpace(scanner.Bytes()), client)
+	}
+
+	err := scanner.Err()
+	if err != nil && err != io.EOF {
+		gelfErrors.Add(s.lc.Name, 1)
+		logrus.WithError(err).WithFields(logrus.Fields{"listener": s.lc.Name, "client": client}).Warn("GELF connection failed")
+	}
+}
+
+func (s *Server) receive() {
+	defer s.wait.Done()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("GELF receive failed")
+			return
+		}
+
+		data := buf[:n]
+		client := addr.String()
+
+		if IsChunked(data) {
+			data, err = s.assembler.Add(data, time.Now())
+			if err != nil {
+				s.logError(err, client, buf[:n])
+				continue
+			}
+
+			// waiting for the remaining chunks
+			if data == nil {
+				continue
+			}
+		}
+
+		data, err = Decompress(data, s.maxSize)
+		if err != nil {
+			s.logError(err, client, buf[:n])
+			continue
+		}
+
+		s.handle(data, client)
+	}
+}
+
+// handle parse the message and submit it tagged with the listener it arrived on
+func (s *Server) handle(data []byte, client string) {
+	if len(data) == 0 {
+		return
+	}
+
+	logParts, err := Parse(data)
+	if err != nil {
+		s.logError(err, client, data)
+		return
+	}
+
+	logParts["client"] = client
+
+	s.submitter.Submit(batching.NewLogEntry(logParts))
+}
+
+func (s *Server) logError(err error, client string, data []byte) {
+	gelfErrors.Add(s.lc.Name, 1)
+
+	logrus.WithError(err).WithFields(logrus.Fields{
+		"listener": s.lc.Name,
+		"client":   client,
+		"data":     describe(data),
+	}).Warn("GELF message rejected")
+}
+
+// splitNUL split messages terminated by a NUL, a trailing message without one is returned at EOF
+func splitNUL(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
@@ -0,0 +1,82 @@
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+type testSubmitter struct {
+	entries chan *batching.LogEntry
+}
+
+func (s *testSubmitter) Submit(entries ...*batching.LogEntry) {
+	for _, entry := range entries {
+		s.entries <- entry
+	}
+}
+
+func Test_WhenReceiveUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer conn.Close()
+
+	submitter := &testSubmitter{entries: make(chan *batching.LogEntry, 10)}
+	server := NewUDPServer(&config.ListenerConfig{Name: "docker", Transport: config.TransportGELFUDP}, conn, submitter)
+	require.Nil(t, server.Boot())
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(testMessage))
+	gw.Close()
+
+	for _, chunk := range testChunks("msgid001", gzipped.Bytes(), 2) {
+		_, err = client.Write(chunk)
+		require.Nil(t, err)
+	}
+
+	entry := <-submitter.entries
+	require.Equal(t, "started", entry.Message)
+	require.Equal(t, client.LocalAddr().String(), entry.Parts["client"])
+
+	// chunked messages may be larger than the frame size limit
+	large := strings.Repeat("x", 100000)
+
+	for _, chunk := range testChunks("msgid002", []byte(`{"short_message":"`+large+`"}`), 16) {
+		_, err = client.Write(chunk)
+		require.Nil(t, err)
+	}
+
+	entry = <-submitter.entries
+	require.Equal(t, large, entry.Message)
+}
+
+func Test_WhenReceiveTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer ln.Close()
+
+	submitter := &testSubmitter{entries: make(chan *batching.LogEntry, 10)}
+	server := NewTCPServer(&config.ListenerConfig{Name: "docker", Transport: config.TransportGELFTCP}, ln, submitter)
+	require.Nil(t, server.Boot())
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+
+	_, err = client.Write([]byte(testMessage + "\x00{\"invalid\x00" + `{"short_message":"second"}`))
+	require.Nil(t, err)
+	client.Close()
+
+	require.Equal(t, "started", (<-submitter.entries).Message)
+	require.Equal(t, "second", (<-submitter.entries).Message)
+}
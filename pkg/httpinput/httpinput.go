@@ -0,0 +1,280 @@
+package httpinput
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/tlsconfig"
+)
+
+// defaults used when the listener doesn't configure a limit
+const (
+	DefaultMaxBodySize   = 1048576
+	DefaultQueueTimeout  = time.Second
+	DefaultHeaderTimeout = 10 * time.Second
+	DefaultReadTimeout   = time.Minute
+	DefaultIdleTimeout   = 2 * time.Minute
+)
+
+// epoch timestamps larger than this are treated as milliseconds rather than seconds
+const maxEpochSeconds = 100000000000
+
+var saturatedRequests = expvar.NewMap("http_saturated_requests")
+
+// Submitter accepts log entries, returning batching.ErrSaturated if they can't be queued within the timeout
+type Submitter interface {
+	SubmitTimeout(timeout time.Duration, entries ...*batching.LogEntry) error
+}
+
+// Server accepts JSON log entries posted over HTTP, each request is answered once
+// all of its entries are queued, or with 429 if the pipeline is saturated
+type Server struct {
+	lc        *config.ListenerConfig
+	listener  net.Listener
+	submitter Submitter
+	server    *http.Server
+	wait      sync.WaitGroup
+}
+
+// NewServer create a new HTTP server accepting requests from the listener
+func NewServer(lc *config.ListenerConfig, listener net.Listener, submitter Submitter) *Server {
+	s := &Server{
+		lc:        lc,
+		listener:  listener,
+		submitter: submitter,
+	}
+
+	// slow or idle clients can't hold connections open, the request headers must arrive within
+	// the handshake timeout and keep alive connections are closed after the idle timeout
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: timeout(lc.HandshakeTimeout, DefaultHeaderTimeout),
+		ReadTimeout:       DefaultReadTimeout,
+		IdleTimeout:       timeout(lc.IdleTimeout, DefaultIdleTimeout),
+	}
+
+	return s
+}
+
+// Boot start serving requests
+func (s *Server) Boot() error {
+	if s.listener == nil {
+		return errors.New("HTTP server has no listener")
+	}
+
+	s.wait.Add(1)
+
+	go func() {
+		defer s.wait.Done()
+
+		err := s.server.Serve(s.listener)
+		if err != nil && err != http.ErrServerClosed {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("HTTP serve failed")
+		}
+	}()
+
+	return nil
+}
+
+// Wait wait until the server stops serving requests
+func (s *Server) Wait() {
+	s.wait.Wait()
+}
+
+// ServeHTTP decode and queue the entries in the request body
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	maxSize := s.lc.MaxBodySize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+
+	objects, err := Decode(http.MaxBytesReader(w, r.Body, maxSize))
+	if err != nil {
+		logrus.WithError(err).WithFields(logrus.Fields{"listener": s.lc.Name, "client": r.RemoteAddr}).Debug("HTTP request rejected")
+
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries := make([]*batching.LogEntry, len(objects))
+
+	for n, object := range objects {
+		entries[n] = s.newLogEntry(r, object)
+	}
+
+	timeout := s.lc.QueueTimeout
+	if timeout <= 0 {
+		timeout = DefaultQueueTimeout
+	}
+
+	err = s.submitter.SubmitTimeout(timeout, entries...)
+	if err != nil {
+		saturatedRequests.Add(s.lc.Name, 1)
+		logrus.WithError(err).WithFields(logrus.Fields{"listener": s.lc.Name, "client": r.RemoteAddr}).Warn("HTTP request not queued")
+
+		w.Header().Set("Retry-After", strconv.Itoa(int(timeout.Seconds()+1)))
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, "{\"accepted\":%d}\n", len(entries))
+}
+
+// newLogEntry tag the object with the client, and convert it to a log entry
+func (s *Server) newLogEntry(r *http.Request, object map[string]interface{}) *batching.LogEntry {
+	field := s.lc.TimestampField
+	if field == "" {
+		field = "timestamp"
+	}
+
+	timestamp, ok := ParseTimestamp(object[field])
+	if !ok {
+		timestamp = time.Now()
+	}
+
+	object["timestamp"] = timestamp
+	object["client"] = r.RemoteAddr
+
+	if r.TLS != nil {
+		object["tls_peer"] = tlsconfig.StatePeerName(s.lc, *r.TLS)
+	}
+
+	// the message is the content of a syslog style message if present
+	if _, ok := object["content"]; !ok {
+		if message, ok := object["message"].(string); ok {
+			object["content"] = message
+		}
+	}
+
+	return batching.NewLogEntry(object)
+}
+
+// Decode decode a single JSON object, an array of objects or newline delimited objects
+func Decode(r io.Reader) ([]map[string]interface{}, error) {
+	reader := bufio.NewReader(r)
+
+	first, err := peekNonSpace(reader)
+	if err != nil {
+		if err == io.EOF {
+			return nil, errors.New("request body is empty")
+		}
+		return nil, errors.Wrap(err, "failed to read request body")
+	}
+
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+
+	objects := []map[string]interface{}{}
+
+	if first == '[' {
+		err = decoder.Decode(&objects)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decode JSON array")
+		}
+	} else {
+		// a single object is decoded the same way as newline delimited objects
+		for {
+			var object map[string]interface{}
+
+			err = decoder.Decode(&object)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to decode JSON object %d", len(objects)+1)
+			}
+
+			objects = append(objects, object)
+		}
+	}
+
+	for n, object := range objects {
+		if object == nil {
+			return nil, fmt.Errorf("entry %d is not a JSON object", n+1)
+		}
+	}
+
+	if len(objects) == 0 {
+		return nil, errors.New("request contains no entries")
+	}
+
+	return objects, nil
+}
+
+// ParseTimestamp parse an RFC 3339 string, or an epoch timestamp in seconds or milliseconds
+func ParseTimestamp(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		timestamp, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}, false
+		}
+		return timestamp, true
+	case json.Number:
+		epoch, err := v.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return epochTime(epoch), true
+	case float64:
+		return epochTime(v), true
+	}
+
+	return time.Time{}, false
+}
+
+func epochTime(epoch float64) time.Time {
+	if epoch > maxEpochSeconds {
+		return time.Unix(0, int64(epoch)*int64(time.Millisecond))
+	}
+
+	return time.Unix(0, int64(epoch*float64(time.Second)))
+}
+
+// peekNonSpace skip leading white space and return the next byte without consuming it
+func peekNonSpace(reader *bufio.Reader) (byte, error) {
+	for {
+		c, err := reader.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		if !bytes.ContainsRune([]byte(" \t\r\n"), rune(c)) {
+			return c, reader.UnreadByte()
+		}
+	}
+}
+
+func timeout(value, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+
+	return value
+}
@@ -0,0 +1,137 @@
+package httpinput
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+type testSubmitter struct {
+	entries []*batching.LogEntry
+	err     error
+}
+
+func (s *testSubmitter) SubmitTimeout(timeout time.Duration, entries ...*batching.LogEntry) error {
+	if s.err != nil {
+		return s.err
+	}
+
+	s.entries = append(s.entries, entries...)
+
+	return nil
+}
+
+func Test_WhenDecode(t *testing.T) {
+	objects, err := Decode(strings.NewReader(`{"message":"one"}`))
+	require.Nil(t, err)
+	require.Len(t, objects, 1)
+
+	objects, err = Decode(strings.NewReader(` [{"message":"one"},{"message":"two"}]`))
+	require.Nil(t, err)
+	require.Len(t, objects, 2)
+
+	objects, err = Decode(strings.NewReader("{\"message\":\"one\"}\n{\"message\":\"two\"}\n{\"message\":\"three\"}\n"))
+	require.Nil(t, err)
+	require.Len(t, objects, 3)
+	require.Equal(t, "three", objects[2]["message"])
+}
+
+func Test_WhenDecodeInvalid(t *testing.T) {
+	for _, body := range []string{
+		"",
+		"  \n",
+		"[]",
+		`{"message":`,
+		`[{"message":"one"},"two"]`,
+		"{\"message\":\"one\"}\nnull\n",
+		`"message"`,
+	} {
+		_, err := Decode(strings.NewReader(body))
+		require.Error(t, err, body)
+	}
+}
+
+func Test_WhenParseTimestamp(t *testing.T) {
+	expected := time.Date(2018, 3, 1, 10, 30, 0, 0, time.UTC)
+
+	for _, value := range []interface{}{"2018-03-01T10:30:00Z", float64(1519900200), float64(1519900200000)} {
+		timestamp, ok := ParseTimestamp(value)
+		require.True(t, ok)
+		require.True(t, expected.Equal(timestamp), "%v", value)
+	}
+
+	_, ok := ParseTimestamp("yesterday")
+	require.False(t, ok)
+
+	_, ok = ParseTimestamp(nil)
+	require.False(t, ok)
+}
+
+func Test_WhenServeHTTP(t *testing.T) {
+	submitter := &testSubmitter{}
+	server := NewServer(&config.ListenerConfig{Name: "api", Transport: config.TransportHTTP, TimestampField: "time"}, nil, submitter)
+
+	body := "{\"message\":\"one\",\"time\":1519900200000}\n{\"message\":\"two\"}\n"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "{\"accepted\":2}\n", w.Body.String())
+	require.Len(t, submitter.entries, 2)
+
+	entry := submitter.entries[0]
+	require.Equal(t, "one", entry.Message)
+	require.Equal(t, int64(1519900200000), entry.MilliTimestamp)
+	require.Equal(t, "192.0.2.1:1234", entry.Parts["client"])
+	require.Nil(t, entry.Parts["tls_peer"])
+}
+
+func Test_WhenServeHTTPSaturated(t *testing.T) {
+	submitter := &testSubmitter{err: batching.ErrSaturated}
+	server := NewServer(&config.ListenerConfig{Name: "api"}, nil, submitter)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message":"one"}`)))
+
+	require.Equal(t, http.StatusTooManyRequests, w.Code)
+	require.Equal(t, "2", w.Header().Get("Retry-After"))
+}
+
+func Test_WhenServeHTTPInvalid(t *testing.T) {
+	server := NewServer(&config.ListenerConfig{Name: "api", MaxBodySize: 10}, nil, &testSubmitter{})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, w.Code)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"message":"too large"}`)))
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"a":`)))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func Test_WhenNewServerTimeouts(t *testing.T) {
+	server := NewServer(&config.ListenerConfig{Name: "api"}, nil, &testSubmitter{})
+
+	require.Equal(t, DefaultHeaderTimeout, server.server.ReadHeaderTimeout)
+	require.Equal(t, DefaultReadTimeout, server.server.ReadTimeout)
+	require.Equal(t, DefaultIdleTimeout, server.server.IdleTimeout)
+
+	lc := &config.ListenerConfig{Name: "api"}
+	lc.HandshakeTimeout = 5 * time.Second
+	lc.IdleTimeout = 30 * time.Second
+
+	server = NewServer(lc, nil, &testSubmitter{})
+
+	require.Equal(t, 5*time.Second, server.server.ReadHeaderTimeout)
+	require.Equal(t, 30*time.Second, server.server.IdleTimeout)
+}
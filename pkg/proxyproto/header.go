@@ -0,0 +1,285 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxy protocol commands, LOCAL connections are initiated by the proxy itself, such as health checks
+const (
+	CommandLocal = "LOCAL"
+	CommandProxy = "PROXY"
+)
+
+// version 2 address families
+const (
+	familyUnspec = 0x0
+	familyInet   = 0x1
+	familyInet6  = 0x2
+	familyUnix   = 0x3
+)
+
+const (
+	// the longest version 1 header including the trailing CRLF
+	maxV1HeaderSize = 107
+	v2HeaderSize    = 16
+	unixAddrSize    = 108
+)
+
+var (
+	v1Signature = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	// ErrNoHeader returned when the connection doesn't start with a proxy protocol header
+	ErrNoHeader = errors.New("connection doesn't start with a proxy protocol header")
+
+	// ErrInvalidHeader returned when a proxy protocol header is malformed
+	ErrInvalidHeader = errors.New("invalid proxy protocol header")
+)
+
+// Header a version 1 or 2 proxy protocol header
+type Header struct {
+	Version int
+	Command string
+	// addresses of the client and the proxy, nil for LOCAL connections and unknown address families
+	Source      net.Addr
+	Destination net.Addr
+	TLVs        []TLV
+}
+
+// TLV a version 2 type-length-value extension
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+func (t TLV) String() string {
+	return fmt.Sprintf("0x%02x:%x", t.Type, t.Value)
+}
+
+// ReadHeader read a version 1 or 2 header from the reader
+func ReadHeader(r *bufio.Reader) (*Header, error) {
+	// peeking the shortest signature first allows short version 1 headers
+	peek, err := r.Peek(len(v1Signature))
+	if err != nil {
+		// connections closed before sending anything are typically health checks
+		if err == io.EOF && len(peek) > 0 {
+			return nil, ErrNoHeader
+		}
+		return nil, err
+	}
+
+	if bytes.Equal(peek, v1Signature) {
+		return readV1Header(r)
+	}
+
+	peek, err = r.Peek(len(v2Signature))
+	if err != nil {
+		if err == io.EOF {
+			return nil, ErrNoHeader
+		}
+		return nil, err
+	}
+
+	if bytes.Equal(peek, v2Signature) {
+		return readV2Header(r)
+	}
+
+	return nil, ErrNoHeader
+}
+
+// readV1Header read a text header in the form PROXY TCP4 src dst srcport dstport\r\n
+func readV1Header(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1HeaderSize)
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, c)
+
+		if c == '\n' {
+			break
+		}
+
+		if len(line) == maxV1HeaderSize {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	header := &Header{Version: 1, Command: CommandProxy}
+
+	// the proxy can't describe the connection, the addresses are ignored
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return header, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	source, err := parseV1Addr(fields[1], fields[2], fields[4])
+	if err != nil {
+		return nil, err
+	}
+
+	destination, err := parseV1Addr(fields[1], fields[3], fields[5])
+	if err != nil {
+		return nil, err
+	}
+
+	header.Source, header.Destination = source, destination
+
+	return header, nil
+}
+
+func parseV1Addr(protocol, ip, port string) (net.Addr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || (protocol == "TCP4") != (addr.To4() != nil) {
+		return nil, ErrInvalidHeader
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+// readV2Header read a binary header with its addresses and TLVs
+func readV2Header(r *bufio.Reader) (*Header, error) {
+	fixed := make([]byte, v2HeaderSize)
+
+	_, err := io.ReadFull(r, fixed)
+	if err != nil {
+		return nil, err
+	}
+
+	if fixed[12]>>4 != 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	header := &Header{Version: 2}
+
+	switch fixed[12] & 0x0f {
+	case 0x0:
+		header.Command = CommandLocal
+	case 0x1:
+		header.Command = CommandProxy
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(fixed[14:16]))
+
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, err
+	}
+
+	family, transport := fixed[13]>>4, fixed[13]&0x0f
+
+	var addrSize int
+
+	switch family {
+	case familyInet:
+		addrSize = 2*net.IPv4len + 4
+	case familyInet6:
+		addrSize = 2*net.IPv6len + 4
+	case familyUnix:
+		addrSize = 2 * unixAddrSize
+	case familyUnspec:
+		addrSize = 0
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	if len(data) < addrSize {
+		return nil, ErrInvalidHeader
+	}
+
+	// addresses of LOCAL connections must be ignored
+	if header.Command == CommandProxy {
+		header.Source, header.Destination = parseV2Addrs(family, transport, data[:addrSize])
+	}
+
+	header.TLVs, err = parseTLVs(data[addrSize:])
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+func parseV2Addrs(family, transport byte, data []byte) (net.Addr, net.Addr) {
+	switch family {
+	case familyInet, familyInet6:
+		size := net.IPv4len
+		if family == familyInet6 {
+			size = net.IPv6len
+		}
+
+		srcPort := int(binary.BigEndian.Uint16(data[2*size:]))
+		dstPort := int(binary.BigEndian.Uint16(data[2*size+2:]))
+
+		if transport == 0x2 {
+			return &net.UDPAddr{IP: net.IP(data[:size]), Port: srcPort}, &net.UDPAddr{IP: net.IP(data[size : 2*size]), Port: dstPort}
+		}
+
+		return &net.TCPAddr{IP: net.IP(data[:size]), Port: srcPort}, &net.TCPAddr{IP: net.IP(data[size : 2*size]), Port: dstPort}
+	case familyUnix:
+		network := "unix"
+		if transport == 0x2 {
+			network = "unixgram"
+		}
+
+		return &net.UnixAddr{Net: network, Name: unixPath(data[:unixAddrSize])}, &net.UnixAddr{Net: network, Name: unixPath(data[unixAddrSize:])}
+	}
+
+	return nil, nil
+}
+
+// unixPath returns the NUL terminated path
+func unixPath(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+
+	return string(data)
+}
+
+func parseTLVs(data []byte) ([]TLV, error) {
+	tlvs := []TLV{}
+
+	for len(data) > 0 {
+		if len(data) < 3 {
+			return nil, ErrInvalidHeader
+		}
+
+		length := int(binary.BigEndian.Uint16(data[1:3]))
+		if len(data) < 3+length {
+			return nil, ErrInvalidHeader
+		}
+
+		tlvs = append(tlvs, TLV{Type: data[0], Value: data[3 : 3+length]})
+		data = data[3+length:]
+	}
+
+	return tlvs, nil
+}
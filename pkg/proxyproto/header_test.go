@@ -0,0 +1,127 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenReadV1Header(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\nhello"))
+
+	header, err := ReadHeader(r)
+	require.Nil(t, err)
+	require.Equal(t, 1, header.Version)
+	require.Equal(t, CommandProxy, header.Command)
+	require.Equal(t, "192.168.0.1:56324", header.Source.String())
+	require.Equal(t, "10.0.0.1:443", header.Destination.String())
+
+	rest, _ := r.ReadString(0)
+	require.Equal(t, "hello", rest)
+
+	header, err = ReadHeader(bufio.NewReader(strings.NewReader("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n")))
+	require.Nil(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", header.Source.String())
+
+	header, err = ReadHeader(bufio.NewReader(strings.NewReader("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")))
+	require.Nil(t, err)
+	require.Nil(t, header.Source)
+}
+
+func Test_WhenReadV1HeaderInvalid(t *testing.T) {
+	for _, data := range []string{
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\n",
+		"PROXY TCP4 2001:db8::1 10.0.0.1 56324 443\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324\r\n",
+		"PROXY TCP4 192.168.0.1 10.0.0.1 56324 99999\r\n",
+		"PROXY UDP4 192.168.0.1 10.0.0.1 56324 443\r\n",
+		"PROXY " + strings.Repeat("A", 120) + "\r\n",
+	} {
+		_, err := ReadHeader(bufio.NewReader(strings.NewReader(data)))
+		require.Equal(t, ErrInvalidHeader, err, data)
+	}
+}
+
+func Test_WhenReadV2Header(t *testing.T) {
+	tlv := []byte{0xea, 0x00, 0x03, 'a', 'b', 'c'}
+
+	addrs := append(net.ParseIP("192.168.0.1").To4(), net.ParseIP("10.0.0.1").To4()...)
+	addrs = append(addrs, 0xdc, 0x04, 0x01, 0xbb)
+
+	header, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x21, 0x11, append(addrs, tlv...)))))
+	require.Nil(t, err)
+	require.Equal(t, 2, header.Version)
+	require.Equal(t, CommandProxy, header.Command)
+	require.Equal(t, "192.168.0.1:56324", header.Source.String())
+	require.Equal(t, "10.0.0.1:443", header.Destination.String())
+	require.Equal(t, []TLV{{Type: 0xea, Value: []byte("abc")}}, header.TLVs)
+
+	addrs = append(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")...)
+	addrs = append(addrs, 0xdc, 0x04, 0x01, 0xbb)
+
+	header, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x21, 0x21, addrs))))
+	require.Nil(t, err)
+	require.Equal(t, "[2001:db8::1]:56324", header.Source.String())
+	require.Equal(t, "[2001:db8::2]:443", header.Destination.String())
+
+	addrs = make([]byte, 2*unixAddrSize)
+	copy(addrs, "/var/run/client.sock")
+	copy(addrs[unixAddrSize:], "/var/run/proxy.sock")
+
+	header, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x21, 0x31, addrs))))
+	require.Nil(t, err)
+	require.Equal(t, "/var/run/client.sock", header.Source.String())
+	require.Equal(t, "/var/run/proxy.sock", header.Destination.String())
+}
+
+func Test_WhenReadV2HeaderLocal(t *testing.T) {
+	header, err := ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x20, 0x00, nil))))
+	require.Nil(t, err)
+	require.Equal(t, CommandLocal, header.Command)
+	require.Nil(t, header.Source)
+
+	// addresses sent with LOCAL connections are ignored
+	addrs := make([]byte, 12)
+
+	header, err = ReadHeader(bufio.NewReader(bytes.NewReader(v2Header(0x20, 0x11, addrs))))
+	require.Nil(t, err)
+	require.Nil(t, header.Source)
+}
+
+func Test_WhenReadV2HeaderInvalid(t *testing.T) {
+	for _, data := range [][]byte{
+		v2Header(0x11, 0x11, make([]byte, 12)),
+		v2Header(0x22, 0x11, make([]byte, 12)),
+		v2Header(0x21, 0x11, make([]byte, 8)),
+		v2Header(0x21, 0x41, nil),
+		v2Header(0x21, 0x11, append(make([]byte, 12), 0xea, 0x00, 0x05, 'a')),
+	} {
+		_, err := ReadHeader(bufio.NewReader(bytes.NewReader(data)))
+		require.Equal(t, ErrInvalidHeader, err, "%x", data)
+	}
+}
+
+func Test_WhenReadNoHeader(t *testing.T) {
+	_, err := ReadHeader(bufio.NewReader(strings.NewReader("<34>Oct 11 22:14:15 mymachine su: test")))
+	require.Equal(t, ErrNoHeader, err)
+
+	_, err = ReadHeader(bufio.NewReader(strings.NewReader("<34>")))
+	require.Equal(t, ErrNoHeader, err)
+
+	_, err = ReadHeader(bufio.NewReader(strings.NewReader("")))
+	require.Equal(t, io.EOF, err)
+}
+
+func v2Header(verCmd, family byte, data []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, verCmd, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(data)))
+
+	return append(header, data...)
+}
@@ -0,0 +1,288 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHeaderTimeout how long to wait for the proxy protocol header
+const DefaultHeaderTimeout = 10 * time.Second
+
+// DefaultMaxPendingHeaders how many connections may be waiting to send their proxy protocol header
+const DefaultMaxPendingHeaders = 1024
+
+// acceptRetryDelay how long to wait before accepting again after a temporary error, such as running out of file descriptors
+const acceptRetryDelay = 50 * time.Millisecond
+
+// Config callbacks invoked for each connection
+type Config struct {
+	// invoked when a connection is closed
+	Trace func(conn *Conn)
+	// invoked when the header can't be read, the connection is closed
+	ProxyHeaderError func(err error)
+	HeaderTimeout    time.Duration
+	// connections which may be waiting for their header at once, once reached no more are accepted until a header
+	// has been read or timed out
+	MaxPendingHeaders int
+}
+
+// Listener accepts connections which start with a version 1 or 2 proxy protocol header
+type Listener struct {
+	net.Listener
+	config *Config
+	// fields decoded from the TLVs of open connections keyed by client address
+	metadata map[string]map[string]string
+	lock     sync.Mutex
+	// connections whose header has been read, and the error which stopped accepting connections
+	accepted  chan *Conn
+	closed    chan struct{}
+	pending   chan struct{}
+	err       error
+	startOnce sync.Once
+}
+
+// NewListener wrap the listener
+func NewListener(ln net.Listener, config *Config) *Listener {
+	if config == nil {
+		config = &Config{}
+	}
+
+	maxPending := config.MaxPendingHeaders
+	if maxPending <= 0 {
+		maxPending = DefaultMaxPendingHeaders
+	}
+
+	return &Listener{
+		Listener: ln,
+		config:   config,
+		metadata: map[string]map[string]string{},
+		accepted: make(chan *Conn),
+		closed:   make(chan struct{}),
+		pending:  make(chan struct{}, maxPending),
+	}
+}
+
+// Metadata returns the fields decoded from the TLVs of the open connection from the client address
+func (l *Listener) Metadata(client string) map[string]string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.metadata[client]
+}
+
+func (l *Listener) register(client string, fields map[string]string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.metadata[client] = fields
+}
+
+func (l *Listener) unregister(client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.metadata, client)
+}
+
+// Accept returns the next connection once its header has been read, headers are read concurrently
+// so a client which is slow to send its header doesn't delay accepting other connections, connections
+// whose header couldn't be read are returned with the error from their first read
+func (l *Listener) Accept() (net.Conn, error) {
+	l.startOnce.Do(func() { go l.accept() })
+
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+func (l *Listener) accept() {
+	for {
+		// wait for a pending header read to finish so clients which never send a header can't exhaust resources
+		l.pending <- struct{}{}
+
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			<-l.pending
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(acceptRetryDelay)
+				continue
+			}
+
+			l.err = err
+			close(l.closed)
+			return
+		}
+
+		go l.readHeader(&Conn{Conn: conn, reader: bufio.NewReader(conn), listener: l, config: l.config})
+	}
+}
+
+func (l *Listener) readHeader(conn *Conn) {
+	conn.Header()
+
+	<-l.pending
+
+	select {
+	case l.accepted <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+// Conn a connection which reports the addresses from its proxy protocol header
+type Conn struct {
+	net.Conn
+	reader       *bufio.Reader
+	listener     *Listener
+	config       *Config
+	header       *Header
+	err          error
+	once         sync.Once
+	closeOnce    sync.Once
+	readCounter  int64
+	writeCounter int64
+	headerRead   int32
+	// client address the TLV fields are registered with the listener under
+	registered string
+	lock       sync.Mutex
+}
+
+// Header returns the proxy protocol header, reading it if this hasn't happened yet
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(c.readHeader)
+
+	return c.header, c.err
+}
+
+// IsLocal returns true if the connection was initiated by the proxy, such as a health check, rather than a client
+func (c *Conn) IsLocal() bool {
+	header, err := c.Header()
+
+	return err != nil || header.Command == CommandLocal
+}
+
+// RemoteAddr returns the client address from the header, or the address of the peer
+// for LOCAL connections and those where the proxy couldn't describe the client
+func (c *Conn) RemoteAddr() net.Addr {
+	header, err := c.Header()
+	if err == nil && header.Source != nil {
+		return header.Source
+	}
+
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the destination address from the header, or the local address of the connection
+func (c *Conn) LocalAddr() net.Addr {
+	header, err := c.Header()
+	if err == nil && header.Destination != nil {
+		return header.Destination
+	}
+
+	return c.Conn.LocalAddr()
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	_, err := c.Header()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := c.reader.Read(b)
+	atomic.AddInt64(&c.readCounter, int64(n))
+
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.writeCounter, int64(n))
+
+	return n, err
+}
+
+// Close close the connection, tracing it the first time it is closed
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		// connections closed before their header was read have nothing to trace
+		if c.config.Trace != nil && atomic.LoadInt32(&c.headerRead) == 1 {
+			c.Trace()
+		}
+
+		c.lock.Lock()
+		if c.registered != "" {
+			c.listener.unregister(c.registered)
+		}
+		c.lock.Unlock()
+	})
+
+	return c.Conn.Close()
+}
+
+// Trace invoke the trace callback
+func (c *Conn) Trace() {
+	c.config.Trace(c)
+}
+
+// ReadCounter returns the number of bytes read after the header
+func (c *Conn) ReadCounter() int64 {
+	return atomic.LoadInt64(&c.readCounter)
+}
+
+// WriteCounter returns the number of bytes written
+func (c *Conn) WriteCounter() int64 {
+	return atomic.LoadInt64(&c.writeCounter)
+}
+
+func (c *Conn) readHeader() {
+	defer atomic.StoreInt32(&c.headerRead, 1)
+
+	timeout := c.config.HeaderTimeout
+	if timeout <= 0 {
+		timeout = DefaultHeaderTimeout
+	}
+
+	c.err = c.Conn.SetReadDeadline(time.Now().Add(timeout))
+	if c.err != nil {
+		return
+	}
+
+	c.header, c.err = ReadHeader(c.reader)
+	if c.err != nil {
+		if c.config.ProxyHeaderError != nil {
+			c.config.ProxyHeaderError(c.err)
+		}
+
+		c.Conn.Close()
+		return
+	}
+
+	if c.header.Source != nil {
+		fields := ParseTLVs(c.header.TLVs).Fields()
+		if len(fields) > 0 {
+			c.lock.Lock()
+			c.registered = c.header.Source.String()
+			c.listener.register(c.registered, fields)
+			c.lock.Unlock()
+		}
+	}
+
+	c.err = c.Conn.SetReadDeadline(time.Time{})
+}
+
+// ClientIP returns the IP address of a client address in the form host:port, other addresses are returned unchanged
+func ClientIP(client string) string {
+	host, _, err := net.SplitHostPort(client)
+	if err != nil {
+		return client
+	}
+
+	return host
+}
@@ -0,0 +1,183 @@
+package proxyproto
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenAcceptProxyConnection(t *testing.T) {
+	traced := make(chan *Conn, 1)
+
+	ln, addr := testListener(t, &Config{Trace: func(conn *Conn) { traced <- conn }})
+	defer ln.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		client.Write([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\nhello"))
+		client.Close()
+	}()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	require.Equal(t, "[2001:db8::1]:56324", conn.RemoteAddr().String())
+	require.Equal(t, "[2001:db8::2]:443", conn.LocalAddr().String())
+
+	data, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(data))
+
+	conn.Close()
+
+	proxyConn := <-traced
+	require.False(t, proxyConn.IsLocal())
+	require.Equal(t, int64(5), proxyConn.ReadCounter())
+}
+
+func Test_WhenAcceptHealthCheck(t *testing.T) {
+	headerErrors := make(chan error, 1)
+
+	ln, addr := testListener(t, &Config{ProxyHeaderError: func(err error) { headerErrors <- err }})
+	defer ln.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		client.Close()
+	}()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	// the socket address is used when there is no header
+	require.NotNil(t, conn.RemoteAddr())
+	require.True(t, conn.(*Conn).IsLocal())
+
+	_, err = conn.Read(make([]byte, 10))
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, io.EOF, <-headerErrors)
+}
+
+func Test_WhenAcceptWithTLVs(t *testing.T) {
+	ln, addr := testListener(t, nil)
+	defer ln.Close()
+
+	tlv := append([]byte{TLVTypeAWS, 0x00, 0x05, TLVSubtypeAWSVPCEndpointID}, "vpce"...)
+	addrs := append(net.ParseIP("192.168.0.1").To4(), net.ParseIP("10.0.0.1").To4()...)
+	addrs = append(addrs, 0xdc, 0x04, 0x01, 0xbb)
+
+	go func() {
+		client, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		client.Write(v2Header(0x21, 0x11, append(addrs, tlv...)))
+	}()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	require.Equal(t, map[string]string{FieldVPCEndpointID: "vpce"}, ln.Metadata("192.168.0.1:56324"))
+
+	conn.Close()
+	require.Nil(t, ln.Metadata("192.168.0.1:56324"))
+}
+
+func Test_WhenAcceptSlowHeader(t *testing.T) {
+	ln, addr := testListener(t, nil)
+	defer ln.Close()
+
+	// a client which hasn't sent its header doesn't delay accepting others
+	slow, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer slow.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		client.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"))
+	}()
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, "192.168.0.1:56324", conn.RemoteAddr().String())
+	conn.Close()
+
+	slow.Write([]byte("PROXY TCP4 192.168.0.2 10.0.0.1 56325 443\r\n"))
+
+	conn, err = ln.Accept()
+	require.Nil(t, err)
+	require.Equal(t, "192.168.0.2:56325", conn.RemoteAddr().String())
+	conn.Close()
+
+	// accept returns the error once the listener is closed
+	ln.Close()
+
+	_, err = ln.Accept()
+	require.Error(t, err)
+}
+
+func Test_WhenAcceptMaxPendingHeaders(t *testing.T) {
+	ln, addr := testListener(t, &Config{HeaderTimeout: 500 * time.Millisecond, MaxPendingHeaders: 1})
+	defer ln.Close()
+
+	slow, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer slow.Close()
+
+	client, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 443\r\n"))
+	require.Nil(t, err)
+
+	accepted := make(chan net.Conn, 2)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// the header of the second connection isn't read until the first times out
+	select {
+	case <-accepted:
+		t.Fatal("accepted a connection while the header of another was pending")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	clients := []string{}
+
+	for n := 0; n < 2; n++ {
+		conn := <-accepted
+		if !conn.(*Conn).IsLocal() {
+			clients = append(clients, conn.RemoteAddr().String())
+		}
+		conn.Close()
+	}
+
+	require.Equal(t, []string{"192.168.0.1:56324"}, clients)
+}
+
+func Test_WhenClientIP(t *testing.T) {
+	require.Equal(t, "10.0.0.1", ClientIP("10.0.0.1:514"))
+	require.Equal(t, "2001:db8::1", ClientIP("[2001:db8::1]:514"))
+	require.Equal(t, "/var/run/syslog.sock", ClientIP("/var/run/syslog.sock"))
+}
+
+func testListener(t *testing.T, config *Config) (*Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	return NewListener(ln, config), ln.Addr().String()
+}
@@ -0,0 +1,83 @@
+package proxyproto
+
+import (
+	"encoding/hex"
+)
+
+// version 2 TLV types
+const (
+	TLVTypeALPN      = 0x01
+	TLVTypeAuthority = 0x02
+	TLVTypeCRC32C    = 0x03
+	TLVTypeNoop      = 0x04
+	TLVTypeUniqueID  = 0x05
+	TLVTypeSSL       = 0x20
+	TLVTypeNetNS     = 0x30
+	// AWS specific TLVs sent by NLB, the first byte of the value is the subtype
+	TLVTypeAWS = 0xea
+)
+
+// TLVSubtypeAWSVPCEndpointID the ID of the VPC endpoint a PrivateLink connection arrived through
+const TLVSubtypeAWSVPCEndpointID = 0x01
+
+// fields of the known TLVs which are attached to each message
+const (
+	FieldVPCEndpointID = "vpce_id"
+	FieldALPN          = "proxy_alpn"
+	FieldAuthority     = "proxy_authority"
+	FieldUniqueID      = "proxy_unique_id"
+	FieldNetNS         = "proxy_netns"
+)
+
+// TLVInfo the decoded values of the known TLVs
+type TLVInfo struct {
+	VPCEndpointID string
+	ALPN          string
+	Authority     string
+	UniqueID      string
+	NetNS         string
+}
+
+// ParseTLVs decode the known TLVs, unknown TLVs are ignored
+func ParseTLVs(tlvs []TLV) TLVInfo {
+	var info TLVInfo
+
+	for _, tlv := range tlvs {
+		switch tlv.Type {
+		case TLVTypeAWS:
+			if len(tlv.Value) > 1 && tlv.Value[0] == TLVSubtypeAWSVPCEndpointID {
+				info.VPCEndpointID = string(tlv.Value[1:])
+			}
+		case TLVTypeALPN:
+			info.ALPN = string(tlv.Value)
+		case TLVTypeAuthority:
+			info.Authority = string(tlv.Value)
+		case TLVTypeUniqueID:
+			// unique ids are opaque bytes
+			info.UniqueID = hex.EncodeToString(tlv.Value)
+		case TLVTypeNetNS:
+			info.NetNS = string(tlv.Value)
+		}
+	}
+
+	return info
+}
+
+// Fields returns the values which are set keyed by their field names
+func (i TLVInfo) Fields() map[string]string {
+	fields := map[string]string{}
+
+	for name, value := range map[string]string{
+		FieldVPCEndpointID: i.VPCEndpointID,
+		FieldALPN:          i.ALPN,
+		FieldAuthority:     i.Authority,
+		FieldUniqueID:      i.UniqueID,
+		FieldNetNS:         i.NetNS,
+	} {
+		if value != "" {
+			fields[name] = value
+		}
+	}
+
+	return fields
+}
@@ -0,0 +1,36 @@
+package proxyproto
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenParseTLVs(t *testing.T) {
+	info := ParseTLVs([]TLV{
+		{Type: TLVTypeAWS, Value: append([]byte{TLVSubtypeAWSVPCEndpointID}, "vpce-08d2bf15fac5001c9"...)},
+		{Type: TLVTypeAuthority, Value: []byte("logs.example.com")},
+		{Type: TLVTypeUniqueID, Value: []byte{0xde, 0xad}},
+		{Type: TLVTypeNoop, Value: []byte{0, 0}},
+		{Type: 0xe0, Value: []byte("custom")},
+	})
+
+	require.Equal(t, TLVInfo{
+		VPCEndpointID: "vpce-08d2bf15fac5001c9",
+		Authority:     "logs.example.com",
+		UniqueID:      "dead",
+	}, info)
+
+	require.Equal(t, map[string]string{
+		FieldVPCEndpointID: "vpce-08d2bf15fac5001c9",
+		FieldAuthority:     "logs.example.com",
+		FieldUniqueID:      "dead",
+	}, info.Fields())
+}
+
+func Test_WhenParseTLVsUnknownAWSSubtype(t *testing.T) {
+	info := ParseTLVs([]TLV{{Type: TLVTypeAWS, Value: []byte{0x02, 'x'}}})
+
+	require.Equal(t, TLVInfo{}, info)
+	require.Len(t, info.Fields(), 0)
+}
@@ -0,0 +1,131 @@
+package relp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// maximum length of the transaction number, command and data length fields
+const (
+	maxTxnrLength    = 9
+	maxCommandLength = 32
+	maxDataLenLength = 9
+)
+
+var (
+	// ErrInvalidFrame returned when a frame doesn't match the RELP frame format
+	ErrInvalidFrame = errors.New("invalid RELP frame")
+
+	// ErrFrameTooLarge returned when the data of a frame exceeds the maximum size
+	ErrFrameTooLarge = errors.New("RELP frame exceeds maximum size")
+)
+
+// Frame a RELP frame in the form TXNR SP COMMAND SP DATALEN [SP DATA] TRAILER
+type Frame struct {
+	Txnr    int
+	Command string
+	Data    []byte
+}
+
+// ReadFrame read a frame, returning an error if the data exceeds the maximum size
+func ReadFrame(r *bufio.Reader, maxSize int) (*Frame, error) {
+	txnr, _, err := readField(r, maxTxnrLength)
+	if err != nil {
+		return nil, err
+	}
+
+	command, _, err := readField(r, maxCommandLength)
+	if err != nil {
+		return nil, err
+	}
+
+	datalen, delim, err := readField(r, maxDataLenLength)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := &Frame{Command: command}
+
+	frame.Txnr, err = strconv.Atoi(txnr)
+	if err != nil {
+		return nil, ErrInvalidFrame
+	}
+
+	length, err := strconv.Atoi(datalen)
+	if err != nil || length < 0 {
+		return nil, ErrInvalidFrame
+	}
+
+	// frames without data are terminated directly after the data length
+	if delim == '\n' {
+		if length != 0 {
+			return nil, ErrInvalidFrame
+		}
+
+		return frame, nil
+	}
+
+	if length > maxSize {
+		return nil, ErrFrameTooLarge
+	}
+
+	frame.Data = make([]byte, length)
+
+	_, err = io.ReadFull(r, frame.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	trailer, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	if trailer != '\n' {
+		return nil, ErrInvalidFrame
+	}
+
+	return frame, nil
+}
+
+// WriteFrame write a frame
+func WriteFrame(w io.Writer, frame *Frame) error {
+	var err error
+
+	if len(frame.Data) == 0 {
+		_, err = fmt.Fprintf(w, "%d %s 0\n", frame.Txnr, frame.Command)
+	} else {
+		_, err = fmt.Fprintf(w, "%d %s %d %s\n", frame.Txnr, frame.Command, len(frame.Data), frame.Data)
+	}
+
+	return err
+}
+
+// readField read a field terminated by a space or new line, returning the field and the terminator
+func readField(r *bufio.Reader, maxLength int) (string, byte, error) {
+	field := make([]byte, 0, maxLength)
+
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+
+		if c == ' ' || c == '\n' {
+			if len(field) == 0 {
+				return "", 0, ErrInvalidFrame
+			}
+
+			return string(field), c, nil
+		}
+
+		if len(field) == maxLength {
+			return "", 0, ErrInvalidFrame
+		}
+
+		field = append(field, c)
+	}
+}
@@ -0,0 +1,60 @@
+package relp
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenReadFrame(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("1 open 5 hello\n2 close 0\n"))
+
+	frame, err := ReadFrame(r, 100)
+	require.Nil(t, err)
+	require.Equal(t, 1, frame.Txnr)
+	require.Equal(t, "open", frame.Command)
+	require.Equal(t, "hello", string(frame.Data))
+
+	frame, err = ReadFrame(r, 100)
+	require.Nil(t, err)
+	require.Equal(t, 2, frame.Txnr)
+	require.Equal(t, "close", frame.Command)
+	require.Len(t, frame.Data, 0)
+}
+
+func Test_WhenReadFrameWithNewLines(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("3 syslog 10 line\nline2\n"))
+
+	frame, err := ReadFrame(r, 100)
+	require.Nil(t, err)
+	require.Equal(t, "line\nline2", string(frame.Data))
+}
+
+func Test_WhenReadFrameInvalid(t *testing.T) {
+	for _, data := range []string{
+		"x open 0\n",
+		"1 open 5\n",
+		"1 open 2 abc\n",
+		"1  open 0\n",
+		"1234567890 open 0\n",
+	} {
+		_, err := ReadFrame(bufio.NewReader(strings.NewReader(data)), 100)
+		require.Equal(t, ErrInvalidFrame, err, data)
+	}
+}
+
+func Test_WhenReadFrameTooLarge(t *testing.T) {
+	_, err := ReadFrame(bufio.NewReader(strings.NewReader("1 syslog 11 hello world\n")), 10)
+	require.Equal(t, ErrFrameTooLarge, err)
+}
+
+func Test_WhenWriteFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	require.Nil(t, WriteFrame(buf, &Frame{Txnr: 1, Command: "rsp", Data: []byte("200 OK")}))
+	require.Nil(t, WriteFrame(buf, &Frame{Txnr: 2, Command: "rsp"}))
+	require.Equal(t, "1 rsp 6 200 OK\n2 rsp 0\n", buf.String())
+}
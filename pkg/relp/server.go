@@ -0,0 +1,219 @@
+package relp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"expvar"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/framing"
+	"github.com/versent/syslog-cloudlogs/pkg/tlsconfig"
+	syslog "github.com/wolfeidau/go-syslog"
+)
+
+// RELP commands
+const (
+	CommandOpen        = "open"
+	CommandClose       = "close"
+	CommandSyslog      = "syslog"
+	CommandRsp         = "rsp"
+	CommandServerClose = "serverclose"
+)
+
+// offers returned in response to an open command
+const openResponse = "200 OK\nrelp_version=0\nrelp_software=syslog-cloudlogs\ncommands=" + CommandSyslog
+
+var relpErrors = expvar.NewMap("relp_errors")
+
+// Submitter accepts log entries, blocking until they are queued
+type Submitter interface {
+	Submit(entries ...*batching.LogEntry)
+}
+
+// Server accepts RELP sessions and acknowledges each message once it has been accepted
+// by the submitter, or once it has been delivered when the listener is in delivered mode
+type Server struct {
+	lc        *config.ListenerConfig
+	listener  net.Listener
+	submitter Submitter
+	maxSize   int
+	peerName  func(tlsConn *tls.Conn) (string, bool)
+	wait      sync.WaitGroup
+}
+
+// NewServer create a new RELP server accepting sessions from the listener
+func NewServer(lc *config.ListenerConfig, listener net.Listener, submitter Submitter) *Server {
+	maxSize := lc.MaxFrameSize
+	if maxSize <= 0 || maxSize > framing.MaxFrameSize {
+		maxSize = framing.MaxFrameSize
+	}
+
+	return &Server{
+		lc:        lc,
+		listener:  listener,
+		submitter: submitter,
+		maxSize:   maxSize,
+		peerName:  tlsconfig.PeerNameFunc(lc),
+	}
+}
+
+// Boot start accepting sessions
+func (s *Server) Boot() error {
+	if s.listener == nil {
+		return errors.New("RELP server has no listener")
+	}
+
+	s.wait.Add(1)
+
+	go s.accept()
+
+	return nil
+}
+
+// Wait wait until the server stops accepting sessions
+func (s *Server) Wait() {
+	s.wait.Wait()
+}
+
+func (s *Server) accept() {
+	defer s.wait.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("RELP accept failed")
+			return
+		}
+
+		go s.serve(conn)
+	}
+}
+
+func (s *Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	sess := &session{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		client: conn.RemoteAddr().String(),
+	}
+
+	// the TLS listener only returns connections which have completed the handshake
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		sess.peer, _ = s.peerName(tlsConn)
+	}
+
+	err := sess.run()
+	if err != nil && err != io.EOF {
+		relpErrors.Add(s.lc.Name, 1)
+		logrus.WithError(err).WithFields(logrus.Fields{"listener": s.lc.Name, "client": sess.client}).Warn("RELP session failed")
+
+		// let the client know the session is over so it retransmits any unacknowledged messages
+		_ = sess.respond(&Frame{Command: CommandServerClose})
+	}
+}
+
+// session a single RELP connection, responses may be written by the dispatcher
+// when messages are acknowledged on delivery so writes are serialised
+type session struct {
+	server *Server
+	conn   net.Conn
+	reader *bufio.Reader
+	client string
+	peer   string
+	open   bool
+	lock   sync.Mutex
+}
+
+func (sess *session) run() error {
+	for {
+		frame, err := ReadFrame(sess.reader, sess.server.maxSize)
+		if err != nil {
+			return err
+		}
+
+		switch frame.Command {
+		case CommandOpen:
+			sess.open = true
+			err = sess.reply(frame.Txnr, openResponse)
+		case CommandClose:
+			err = sess.reply(frame.Txnr, "")
+			if err == nil {
+				return nil
+			}
+		case CommandSyslog:
+			if !sess.open {
+				err = sess.reply(frame.Txnr, "500 session not open")
+				break
+			}
+			err = sess.syslog(frame)
+		default:
+			err = sess.reply(frame.Txnr, "500 unsupported command "+frame.Command)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// syslog parse the message and submit it, acknowledging once accepted or delivered
+func (sess *session) syslog(frame *Frame) error {
+	parser := syslog.Automatic.GetParser(frame.Data)
+
+	err := parser.Parse()
+	if err != nil {
+		return sess.reply(frame.Txnr, "500 invalid syslog message")
+	}
+
+	logParts := parser.Dump()
+	logParts["client"] = sess.client
+
+	if sess.peer != "" {
+		logParts["tls_peer"] = sess.peer
+	}
+
+	entry := batching.NewLogEntry(logParts)
+
+	if sess.server.lc.AckMode == config.AckModeDelivered {
+		txnr := frame.Txnr
+
+		entry.Ack = func(err error) {
+			msg := "200 OK"
+			if err != nil {
+				msg = "500 delivery failed"
+			}
+
+			err = sess.reply(txnr, msg)
+			if err != nil {
+				logrus.WithError(err).WithField("client", sess.client).Debug("RELP ack failed")
+			}
+		}
+
+		sess.server.submitter.Submit(entry)
+
+		return nil
+	}
+
+	sess.server.submitter.Submit(entry)
+
+	return sess.reply(frame.Txnr, "200 OK")
+}
+
+func (sess *session) reply(txnr int, msg string) error {
+	return sess.respond(&Frame{Txnr: txnr, Command: CommandRsp, Data: []byte(msg)})
+}
+
+func (sess *session) respond(frame *Frame) error {
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+
+	return WriteFrame(sess.conn, frame)
+}
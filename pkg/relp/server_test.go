@@ -0,0 +1,120 @@
+package relp
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+type testSubmitter struct {
+	entries chan *batching.LogEntry
+}
+
+func (s *testSubmitter) Submit(entries ...*batching.LogEntry) {
+	for _, entry := range entries {
+		s.entries <- entry
+	}
+}
+
+func Test_WhenSessionAcceptedMode(t *testing.T) {
+	submitter, conn, r := testSession(t, config.AckModeAccepted)
+	defer conn.Close()
+
+	sendFrame(t, conn, 1, CommandOpen, "relp_version=0")
+	frame := readFrame(t, r)
+	require.Equal(t, 1, frame.Txnr)
+	require.Equal(t, openResponse, string(frame.Data))
+
+	sendFrame(t, conn, 2, CommandSyslog, "<34>Oct 11 22:14:15 mymachine su: test")
+
+	entry := <-submitter.entries
+	require.Equal(t, conn.LocalAddr().String(), entry.Parts["client"])
+	require.Nil(t, entry.Ack)
+
+	frame = readFrame(t, r)
+	require.Equal(t, 2, frame.Txnr)
+	require.Equal(t, "200 OK", string(frame.Data))
+
+	sendFrame(t, conn, 3, CommandClose, "")
+	frame = readFrame(t, r)
+	require.Equal(t, 3, frame.Txnr)
+	require.Len(t, frame.Data, 0)
+}
+
+func Test_WhenSessionDeliveredMode(t *testing.T) {
+	submitter, conn, r := testSession(t, config.AckModeDelivered)
+	defer conn.Close()
+
+	sendFrame(t, conn, 1, CommandOpen, "relp_version=0")
+	readFrame(t, r)
+
+	sendFrame(t, conn, 2, CommandSyslog, "<34>Oct 11 22:14:15 mymachine su: first")
+	sendFrame(t, conn, 3, CommandSyslog, "<34>Oct 11 22:14:15 mymachine su: second")
+
+	first := <-submitter.entries
+	second := <-submitter.entries
+	require.NotNil(t, first.Ack)
+
+	// nothing is acknowledged until the entries are delivered
+	batching.AckEntries([]*batching.LogEntry{second}, fmt.Errorf("failed"))
+	frame := readFrame(t, r)
+	require.Equal(t, 3, frame.Txnr)
+	require.Equal(t, "500 delivery failed", string(frame.Data))
+
+	batching.AckEntries([]*batching.LogEntry{first}, nil)
+	frame = readFrame(t, r)
+	require.Equal(t, 2, frame.Txnr)
+	require.Equal(t, "200 OK", string(frame.Data))
+}
+
+func Test_WhenSessionNotOpen(t *testing.T) {
+	_, conn, r := testSession(t, config.AckModeAccepted)
+	defer conn.Close()
+
+	sendFrame(t, conn, 1, CommandSyslog, "<34>Oct 11 22:14:15 mymachine su: test")
+	frame := readFrame(t, r)
+	require.Equal(t, "500 session not open", string(frame.Data))
+}
+
+func Test_WhenSessionInvalidFrame(t *testing.T) {
+	_, conn, r := testSession(t, config.AckModeAccepted)
+	defer conn.Close()
+
+	_, err := conn.Write([]byte("x open 0\n"))
+	require.Nil(t, err)
+
+	frame := readFrame(t, r)
+	require.Equal(t, CommandServerClose, frame.Command)
+}
+
+func testSession(t *testing.T, ackMode string) (*testSubmitter, net.Conn, *bufio.Reader) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	lc := &config.ListenerConfig{Name: "relp", Transport: config.TransportRELP, AckMode: ackMode}
+	submitter := &testSubmitter{entries: make(chan *batching.LogEntry, 10)}
+
+	server := NewServer(lc, ln, submitter)
+	require.Nil(t, server.Boot())
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.Nil(t, err)
+
+	return submitter, conn, bufio.NewReader(conn)
+}
+
+func sendFrame(t *testing.T, conn net.Conn, txnr int, command, data string) {
+	require.Nil(t, WriteFrame(conn, &Frame{Txnr: txnr, Command: command, Data: []byte(data)}))
+}
+
+func readFrame(t *testing.T, r *bufio.Reader) *Frame {
+	frame, err := ReadFrame(r, 1024)
+	require.Nil(t, err)
+
+	return frame
+}
@@ -0,0 +1,206 @@
+package sourceacl
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// ErrSourceRejected returned when reading from a connection whose client address isn't permitted
+var ErrSourceRejected = errors.New("client address is not permitted")
+
+var (
+	rejectedConnections = expvar.NewMap("rejected_connections")
+	rejectedDatagrams   = expvar.NewMap("rejected_datagrams")
+)
+
+// Filter permits client addresses which are in an allowed network, if any are configured, and not in a denied network
+type Filter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewFilter create a filter from the sources configured for the listener, returns nil if none are configured
+func NewFilter(lc *config.ListenerConfig) (*Filter, error) {
+	if len(lc.AllowSources) == 0 && len(lc.DenySources) == 0 {
+		return nil, nil
+	}
+
+	allow, err := config.ParseNetworks(lc.AllowSources)
+	if err != nil {
+		return nil, err
+	}
+
+	deny, err := config.ParseNetworks(lc.DenySources)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{allow: allow, deny: deny}, nil
+}
+
+// Permits returns true if the address is permitted, addresses without an IP such as UNIX sockets
+// are only permitted when there are no allowed networks
+func (f *Filter) Permits(addr net.Addr) bool {
+	ip := addrIP(addr)
+
+	if ip != nil && contains(f.deny, ip) {
+		return false
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	return ip != nil && contains(f.allow, ip)
+}
+
+// PermitsDatagram returns true if datagrams from the address are permitted, those which aren't are counted against
+// the listener name, they're only logged at debug level as a flood of datagrams would otherwise flood the log
+func (f *Filter) PermitsDatagram(name string, addr net.Addr) bool {
+	if f.Permits(addr) {
+		return true
+	}
+
+	rejectedDatagrams.Add(name, 1)
+	logrus.WithFields(logrus.Fields{"listener": name, "client": addrString(addr)}).Debug("datagram rejected by source filter")
+
+	return false
+}
+
+func contains(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+
+	return nil
+}
+
+// Listener closes connections from clients the filter doesn't permit, when deferred the check is made on the
+// first read so the address can come from a proxy protocol header without blocking accept, in either case
+// the check is made before any data, such as a TLS handshake, is exchanged with the client
+type Listener struct {
+	net.Listener
+	name     string
+	filter   *Filter
+	deferred bool
+}
+
+// NewListener wrap the listener, name is the listener name used when recording rejected connections
+func NewListener(ln net.Listener, name string, filter *Filter, deferred bool) *Listener {
+	return &Listener{
+		Listener: ln,
+		name:     name,
+		filter:   filter,
+		deferred: deferred,
+	}
+}
+
+// Accept waits for and returns the next connection which isn't rejected
+func (l *Listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.deferred {
+			return &Conn{Conn: conn, listener: l}, nil
+		}
+
+		if l.permits(conn) {
+			return conn, nil
+		}
+
+		conn.Close()
+	}
+}
+
+func (l *Listener) permits(conn net.Conn) bool {
+	addr := conn.RemoteAddr()
+
+	if l.filter.Permits(addr) {
+		return true
+	}
+
+	rejectedConnections.Add(l.name, 1)
+	logrus.WithFields(logrus.Fields{"listener": l.name, "client": addrString(addr)}).Warn("connection rejected by source filter")
+
+	return false
+}
+
+// Conn checks the client address on the first read, closing the connection if it isn't permitted
+type Conn struct {
+	net.Conn
+	listener *Listener
+	once     sync.Once
+	err      error
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		if !c.listener.permits(c.Conn) {
+			c.err = ErrSourceRejected
+			c.Conn.Close()
+		}
+	})
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	return c.Conn.Read(b)
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+// PacketConn drops datagrams from clients the filter doesn't permit
+type PacketConn struct {
+	net.PacketConn
+	name   string
+	filter *Filter
+}
+
+// NewPacketConn wrap the connection, name is the listener name used when recording rejected datagrams
+func NewPacketConn(conn net.PacketConn, name string, filter *Filter) *PacketConn {
+	return &PacketConn{
+		PacketConn: conn,
+		name:       name,
+		filter:     filter,
+	}
+}
+
+// ReadFrom waits for and returns the next datagram which isn't rejected
+func (c *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		if err != nil || c.filter.PermitsDatagram(c.name, addr) {
+			return n, addr, err
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package sourceacl
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/versent/syslog-cloudlogs/pkg/proxyproto"
+)
+
+func Test_WhenFilterPermits(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{
+		AllowSources: []string{"10.0.0.0/8", "2001:db8::/32"},
+		DenySources:  []string{"10.1.0.0/16", "10.2.3.4"},
+	})
+	require.Nil(t, err)
+
+	tests := []struct {
+		addr    net.Addr
+		permits bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.0.1")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.4")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.2.3.5")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{&net.UnixAddr{Name: "/tmp/test.sock", Net: "unix"}, false},
+		{nil, false},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.permits, filter.Permits(tt.addr), "addr %v", tt.addr)
+	}
+}
+
+func Test_WhenFilterOnlyDenies(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{DenySources: []string{"192.168.0.0/16"}})
+	require.Nil(t, err)
+
+	require.True(t, filter.Permits(&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}))
+	require.False(t, filter.Permits(&net.TCPAddr{IP: net.ParseIP("192.168.1.1")}))
+	require.True(t, filter.Permits(&net.UnixAddr{Name: "/tmp/test.sock", Net: "unix"}))
+}
+
+func Test_WhenNoSourcesConfigured(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{})
+	require.Nil(t, err)
+	require.Nil(t, filter)
+
+	_, err = NewFilter(&config.ListenerConfig{AllowSources: []string{"10.0.0.0/33"}})
+	require.Error(t, err)
+}
+
+func Test_WhenPacketConnRejectsSource(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{AllowSources: []string{"127.0.0.1"}, DenySources: []string{"127.0.0.1"}})
+	require.Nil(t, err)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Nil(t, err)
+	defer pc.Close()
+
+	conn := NewPacketConn(pc, "test", filter)
+
+	client, err := net.Dial("udp", pc.LocalAddr().String())
+	require.Nil(t, err)
+	defer client.Close()
+
+	_, err = client.Write([]byte("rejected"))
+	require.Nil(t, err)
+
+	// the datagram is dropped so the read times out
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+
+	_, _, err = conn.ReadFrom(make([]byte, 100))
+	require.Error(t, err)
+	require.True(t, err.(net.Error).Timeout())
+
+	filter, err = NewFilter(&config.ListenerConfig{AllowSources: []string{"127.0.0.1"}})
+	require.Nil(t, err)
+
+	conn = NewPacketConn(pc, "test", filter)
+	require.Nil(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = client.Write([]byte("permitted"))
+	require.Nil(t, err)
+
+	buf := make([]byte, 100)
+	n, addr, err := conn.ReadFrom(buf)
+	require.Nil(t, err)
+	require.Equal(t, "permitted", string(buf[:n]))
+	require.Equal(t, client.LocalAddr().String(), addr.String())
+}
+
+func Test_WhenListenerRejectsSocketPeer(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{AllowSources: []string{"127.0.0.2"}})
+	require.Nil(t, err)
+
+	ln, addr := testListener(t, filter, false, false)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	client, err := net.Dial("tcp", addr)
+	require.Nil(t, err)
+
+	// the connection is closed by the listener without being returned
+	_, err = ioutil.ReadAll(client)
+	require.Nil(t, err)
+	client.Close()
+
+	select {
+	case conn := <-accepted:
+		t.Fatalf("connection from %s accepted", conn.RemoteAddr())
+	default:
+	}
+}
+
+func Test_WhenListenerChecksProxySource(t *testing.T) {
+	filter, err := NewFilter(&config.ListenerConfig{DenySources: []string{"192.0.2.0/24"}})
+	require.Nil(t, err)
+
+	ln, addr := testListener(t, filter, true, true)
+	defer ln.Close()
+
+	send := func(header string) {
+		client, err := net.Dial("tcp", addr)
+		require.Nil(t, err)
+		client.Write([]byte(header + "hello"))
+		client.Close()
+	}
+
+	go send("PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n")
+
+	conn, err := ln.Accept()
+	require.Nil(t, err)
+
+	_, err = ioutil.ReadAll(conn)
+	require.Equal(t, ErrSourceRejected, err)
+	conn.Close()
+
+	go send("PROXY TCP4 198.51.100.1 192.0.2.2 56324 443\r\n")
+
+	conn, err = ln.Accept()
+	require.Nil(t, err)
+
+	data, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+	require.Equal(t, "hello", string(data))
+	conn.Close()
+}
+
+func testListener(t *testing.T, filter *Filter, proxy, deferred bool) (net.Listener, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	addr := ln.Addr().String()
+
+	if proxy {
+		ln = proxyproto.NewListener(ln, &proxyproto.Config{})
+	}
+
+	return NewListener(ln, "test", filter, deferred), addr
+}
@@ -0,0 +1,744 @@
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+const (
+	segmentSuffix  = ".seg"
+	checkpointName = "checkpoint"
+	// each record is preceded by its length and CRC32 checksum
+	headerSize = 8
+	// records larger than this are treated as corrupt rather than allocated
+	maxRecordSize = 64 * 1024 * 1024
+	// delays between attempts to deliver the entries of a batch which failed, when not configured
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = time.Minute
+)
+
+var (
+	errClosed     = errors.New("spool closed")
+	errIncomplete = errors.New("incomplete record")
+)
+
+var (
+	spoolBatches = expvar.NewMap("spool_batches")
+	spoolBytes   = expvar.NewInt("spool_bytes")
+	spoolDropped = expvar.NewInt("spool_dropped_events")
+)
+
+// Spool a write ahead queue of batches on disk between the batcher and the dispatcher, batches are appended
+// to segment files and dispatched in order, the position of the last dispatched batch is kept in a checkpoint
+// so batches which weren't dispatched before a crash or restart are replayed when the spool is opened
+type Spool struct {
+	dir          string
+	segmentSize  int64
+	maxSize      int64
+	syncPolicy   string
+	dispatchFunc batching.DispatchFunc
+	retryBase    time.Duration
+	retryMax     time.Duration
+
+	lock     sync.Mutex
+	space    *sync.Cond
+	running  sync.WaitGroup
+	segments []uint64
+	sizes    map[uint64]int64
+	size     int64
+	file     *os.File
+	fileID   uint64
+	dirty    bool
+	closed   bool
+	notify   chan struct{}
+	done     chan struct{}
+
+	// position of the next batch to dispatch, only used by Run
+	readID     uint64
+	readOffset int64
+	readFile   *os.File
+}
+
+// checkpoint the position of the next batch to dispatch
+type checkpoint struct {
+	Segment uint64 `json:"segment"`
+	Offset  int64  `json:"offset"`
+}
+
+// record a batch as written to a segment
+type record struct {
+	Events []event `json:"events"`
+}
+
+type event struct {
+	Timestamp int64           `json:"timestamp"`
+	Received  time.Time       `json:"received"`
+	Message   json.RawMessage `json:"message"`
+}
+
+// Open open the spool in the configured directory, creating it if needed, batches are passed to the dispatch function
+// by Run, and directly if they can't be written to the spool
+func Open(sc *config.SyslogConfig, dispatchFunc batching.DispatchFunc) (*Spool, error) {
+	s := &Spool{
+		dir:          sc.SpoolDir,
+		segmentSize:  sc.SpoolSegmentSize,
+		maxSize:      sc.SpoolMaxSize,
+		syncPolicy:   sc.SpoolSync,
+		dispatchFunc: dispatchFunc,
+		retryBase:    sc.RetryBaseDelay,
+		retryMax:     sc.RetryMaxDelay,
+		sizes:        map[uint64]int64{},
+		notify:       make(chan struct{}, 1),
+		done:         make(chan struct{}),
+	}
+
+	s.space = sync.NewCond(&s.lock)
+
+	err := os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create spool directory")
+	}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	// new batches are always written to a new segment so any partly written record is left behind
+	err = s.rotate()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.syncPolicy == config.SyncInterval && sc.SpoolSyncInterval > 0 {
+		go s.syncEvery(sc.SpoolSyncInterval)
+	}
+
+	return s, nil
+}
+
+// load find the segments on disk and the position of the next batch to dispatch, removing segments which have been dispatched
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "failed to read spool directory")
+	}
+
+	for _, file := range files {
+		id, ok := parseSegmentName(file.Name())
+		if !ok {
+			continue
+		}
+
+		s.segments = append(s.segments, id)
+		s.sizes[id] = file.Size()
+		s.size += file.Size()
+	}
+
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+
+	cp, err := s.readCheckpoint()
+	if err != nil {
+		return err
+	}
+
+	for len(s.segments) > 0 && s.segments[0] < cp.Segment {
+		err = s.remove(s.segments[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	// new segments must follow the checkpoint, otherwise they'd be removed as dispatched when next opened
+	s.fileID = cp.Segment
+
+	if len(s.segments) > 0 {
+		s.readID = s.segments[0]
+
+		if last := s.segments[len(s.segments)-1]; last > s.fileID {
+			s.fileID = last
+		}
+		if s.readID == cp.Segment {
+			s.readOffset = cp.Offset
+		}
+	}
+
+	pending := s.size - s.readOffset
+	if pending > 0 {
+		logrus.WithFields(logrus.Fields{
+			"dir":      s.dir,
+			"segments": len(s.segments),
+			"bytes":    pending,
+		}).Info("replaying spooled batches")
+	}
+
+	spoolBytes.Set(s.size)
+
+	return nil
+}
+
+// Append write the batch to the spool, the entries are acknowledged once written, and synced if the policy is always,
+// this waits while the spool is full, batches which can't be written are dispatched directly
+func (s *Spool) Append(entries []*batching.LogEntry) {
+	err := s.write(entries)
+	if err != nil {
+		spoolBatches.Add("failed", 1)
+		logrus.WithError(err).WithField("events", len(entries)).Error("spool write failed, dispatching batch directly")
+
+		s.dispatchFunc(entries)
+		return
+	}
+
+	spoolBatches.Add("written", 1)
+
+	batching.AckEntries(entries, nil)
+}
+
+func (s *Spool) write(entries []*batching.LogEntry) error {
+	data, err := encodeRecord(entries)
+	if err != nil {
+		return err
+	}
+
+	size := int64(len(data))
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	full := false
+
+	// only wait when there are older segments which will be removed once they've been dispatched
+	for !s.closed && s.size+size > s.maxSize && len(s.segments) > 1 {
+		if !full {
+			full = true
+			spoolBatches.Add("full", 1)
+			logrus.WithFields(logrus.Fields{"dir": s.dir, "bytes": s.size}).Warn("spool is full, waiting for batches to be dispatched")
+		}
+
+		s.space.Wait()
+	}
+
+	if s.closed {
+		return errClosed
+	}
+
+	// a segment may also be missing if a previous rotation failed
+	if s.file == nil || (s.sizes[s.fileID] > 0 && s.sizes[s.fileID]+size > s.segmentSize) {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = s.file.Write(data)
+	if err != nil {
+		// leave any partly written record at the end of the segment, where it's skipped once the segment is read
+		if rerr := s.rotate(); rerr != nil {
+			logrus.WithError(rerr).Error("spool segment rotation failed")
+		}
+
+		return errors.Wrap(err, "failed to write spool segment")
+	}
+
+	s.sizes[s.fileID] += size
+	s.size += size
+	spoolBytes.Set(s.size)
+
+	if s.syncPolicy == config.SyncAlways {
+		// the record has been written so it will be dispatched, even if it may not survive a crash
+		err = s.file.Sync()
+		if err != nil {
+			logrus.WithError(err).Error("spool segment sync failed")
+		}
+	} else {
+		s.dirty = true
+	}
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// rotate close the current segment and start writing a new one, called with the lock held
+func (s *Spool) rotate() error {
+	if s.file != nil {
+		if s.syncPolicy != config.SyncNone {
+			s.file.Sync()
+		}
+
+		s.file.Close()
+		s.file = nil
+	}
+
+	id := s.fileID + 1
+
+	file, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create spool segment")
+	}
+
+	if len(s.segments) == 0 {
+		s.readID = id
+	}
+
+	s.file = file
+	s.fileID = id
+	s.dirty = false
+	s.segments = append(s.segments, id)
+	s.sizes[id] = 0
+
+	return nil
+}
+
+// Run dispatch the spooled batches in order, waiting for new batches once they've all been dispatched, until the spool is closed,
+// the checkpoint only moves past a batch once all of its entries have been delivered or dead lettered
+func (s *Spool) Run() {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return
+	}
+	s.running.Add(1)
+	s.lock.Unlock()
+
+	defer s.running.Done()
+
+	for {
+		entries, next, err := s.next()
+		if err == errClosed {
+			return
+		}
+		if err != nil {
+			logrus.WithError(err).Error("spool read failed")
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// a batch which isn't delivered before the spool is closed is replayed when it's next opened
+		if !s.deliver(entries) {
+			return
+		}
+
+		spoolBatches.Add("dispatched", 1)
+
+		s.readOffset = next
+
+		err = s.writeCheckpoint()
+		if err != nil {
+			logrus.WithError(err).Error("spool checkpoint write failed")
+		}
+	}
+}
+
+// deliver dispatch the batch, retrying the entries which fail with a retriable error with backoff until
+// they're all delivered or dropped, returns false if the spool is closed first
+func (s *Spool) deliver(entries []*batching.LogEntry) bool {
+	for attempt := 0; ; attempt++ {
+		entries = s.dispatch(entries)
+		if len(entries) == 0 {
+			return true
+		}
+
+		delay := s.backoff(attempt)
+
+		spoolBatches.Add("retried", 1)
+		logrus.WithFields(logrus.Fields{
+			"events":  len(entries),
+			"attempt": attempt + 1,
+			"delay":   delay.String(),
+		}).Warn("spooled batch not delivered, retrying")
+
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return false
+		}
+	}
+}
+
+// dispatch pass the entries to the dispatch function, returning those which were acknowledged with a retriable
+// error, those which failed with an error that dispatching them again won't fix are dropped
+func (s *Spool) dispatch(entries []*batching.LogEntry) []*batching.LogEntry {
+	var (
+		lock    sync.Mutex
+		failed  []*batching.LogEntry
+		dropped int64
+		last    error
+	)
+
+	for _, entry := range entries {
+		entry := entry
+		entry.Ack = func(err error) {
+			if err == nil {
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+
+			if !batching.IsRetriable(err) {
+				dropped++
+				last = err
+				return
+			}
+
+			failed = append(failed, entry)
+		}
+	}
+
+	s.dispatchFunc(entries)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if dropped > 0 {
+		spoolDropped.Add(dropped)
+		logrus.WithError(last).WithField("events", dropped).Error("spooled events can't be delivered, dropping")
+	}
+
+	return failed
+}
+
+// backoff returns the delay before retrying, the base delay doubled for each attempt up to the max delay
+func (s *Spool) backoff(attempt int) time.Duration {
+	base, max := s.retryBase, s.retryMax
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	if max <= 0 {
+		max = defaultRetryMaxDelay
+	}
+
+	delay := base
+	for n := 0; n < attempt && delay < max; n++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
+
+// next returns the next batch to dispatch and the offset following it, skipping the rest of any segment holding
+// a corrupt record, this blocks until a batch is written or the spool is closed
+func (s *Spool) next() ([]*batching.LogEntry, int64, error) {
+	for {
+		s.lock.Lock()
+		current := s.readID == s.fileID
+		closed := s.closed
+		s.lock.Unlock()
+
+		if closed {
+			return nil, 0, errClosed
+		}
+
+		if s.readFile == nil {
+			file, err := os.Open(s.segmentPath(s.readID))
+			if err != nil {
+				return nil, 0, errors.Wrap(err, "failed to open spool segment")
+			}
+
+			s.readFile = file
+		}
+
+		entries, next, err := readRecord(s.readFile, s.readOffset)
+		switch {
+		case err == nil:
+			return entries, next, nil
+		case err == errIncomplete && current:
+			// the writer is still appending to this segment
+			select {
+			case <-s.notify:
+			case <-s.done:
+			}
+			continue
+		case err == errIncomplete:
+			if info, serr := s.readFile.Stat(); serr == nil && info.Size() > s.readOffset {
+				logrus.WithFields(logrus.Fields{"segment": s.readID, "offset": s.readOffset}).Warn("skipping partly written spool record")
+			}
+		default:
+			spoolBatches.Add("corrupt", 1)
+			logrus.WithError(err).WithFields(logrus.Fields{"segment": s.readID, "offset": s.readOffset}).Error("skipping corrupt spool segment")
+
+			if current {
+				s.lock.Lock()
+				err = s.rotate()
+				s.lock.Unlock()
+
+				if err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+
+		err = s.advance()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+}
+
+// advance remove the segment which has been dispatched and move on to the next one
+func (s *Spool) advance() error {
+	s.readFile.Close()
+	s.readFile = nil
+
+	s.lock.Lock()
+
+	err := s.remove(s.readID)
+	if err == nil {
+		s.readID, s.readOffset = s.segments[0], 0
+	}
+
+	s.space.Broadcast()
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.writeCheckpoint()
+}
+
+// remove delete the oldest segment, called with the lock held
+func (s *Spool) remove(id uint64) error {
+	err := os.Remove(s.segmentPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove spool segment")
+	}
+
+	s.size -= s.sizes[id]
+	spoolBytes.Set(s.size)
+
+	delete(s.sizes, id)
+	s.segments = s.segments[1:]
+
+	return nil
+}
+
+// Close stop dispatching once the current batch has been dispatched and sync the current segment
+func (s *Spool) Close() error {
+	s.lock.Lock()
+
+	if s.closed {
+		s.lock.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	close(s.done)
+	s.space.Broadcast()
+
+	var err error
+
+	if s.file != nil {
+		if s.syncPolicy != config.SyncNone {
+			s.file.Sync()
+		}
+
+		err = s.file.Close()
+	}
+
+	s.lock.Unlock()
+
+	// let the batch being dispatched finish so its checkpoint is written
+	s.running.Wait()
+
+	return err
+}
+
+func (s *Spool) syncEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		s.lock.Lock()
+
+		if s.dirty && s.file != nil {
+			err := s.file.Sync()
+			if err != nil {
+				logrus.WithError(err).Error("spool segment sync failed")
+			}
+
+			s.dirty = false
+		}
+
+		s.lock.Unlock()
+	}
+}
+
+func (s *Spool) readCheckpoint() (checkpoint, error) {
+	cp := checkpoint{}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, checkpointName))
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, errors.Wrap(err, "failed to read spool checkpoint")
+	}
+
+	err = json.Unmarshal(data, &cp)
+	if err != nil {
+		return cp, errors.Wrap(err, "failed to decode spool checkpoint")
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint replace the checkpoint with the position of the next batch to dispatch, a checkpoint lost in
+// a crash only causes batches to be dispatched again
+func (s *Spool) writeCheckpoint() error {
+	data, err := json.Marshal(&checkpoint{Segment: s.readID, Offset: s.readOffset})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.dir, checkpointName)
+
+	file, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create spool checkpoint")
+	}
+
+	_, err = file.Write(data)
+	if err == nil && s.syncPolicy == config.SyncAlways {
+		err = file.Sync()
+	}
+
+	cerr := file.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to write spool checkpoint")
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func parseSegmentName(name string) (uint64, bool) {
+	if !strings.HasSuffix(name, segmentSuffix) {
+		return 0, false
+	}
+
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return id, true
+}
+
+// encodeRecord returns the batch encoded as a record preceded by its header
+func encodeRecord(entries []*batching.LogEntry) ([]byte, error) {
+	rec := record{Events: make([]event, 0, len(entries))}
+
+	for _, entry := range entries {
+		data, err := entry.Encoded()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to marshal log entry into json")
+		}
+
+		rec.Events = append(rec.Events, event{
+			Timestamp: entry.MilliTimestamp,
+			Received:  entry.Received,
+			Message:   data,
+		})
+	}
+
+	payload, err := json.Marshal(&rec)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, headerSize, headerSize+len(payload))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(data[4:8], crc32.ChecksumIEEE(payload))
+
+	return append(data, payload...), nil
+}
+
+// readRecord returns the entries of the record at the offset and the offset following it, errIncomplete is
+// returned if the record hasn't been completely written
+func readRecord(file *os.File, offset int64) ([]*batching.LogEntry, int64, error) {
+	header := make([]byte, headerSize)
+
+	_, err := file.ReadAt(header, offset)
+	if err == io.EOF {
+		return nil, 0, errIncomplete
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read spool record")
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > maxRecordSize {
+		return nil, 0, fmt.Errorf("spool record length %d is invalid", length)
+	}
+
+	payload := make([]byte, length)
+
+	_, err = file.ReadAt(payload, offset+headerSize)
+	if err == io.EOF {
+		return nil, 0, errIncomplete
+	}
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to read spool record")
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("spool record checksum mismatch")
+	}
+
+	rec := record{}
+
+	err = json.Unmarshal(payload, &rec)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to decode spool record")
+	}
+
+	entries := make([]*batching.LogEntry, 0, len(rec.Events))
+
+	for _, ev := range rec.Events {
+		entry, err := batching.DecodeLogEntry(ev.Message, ev.Timestamp, ev.Received)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to decode spooled event")
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, offset + headerSize + int64(length), nil
+}
@@ -0,0 +1,387 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/batching"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+	"github.com/wolfeidau/go-syslog/format"
+)
+
+func newSpoolConfig(t *testing.T) *config.SyslogConfig {
+	dir, err := ioutil.TempDir("", "spool")
+	require.Nil(t, err)
+
+	return &config.SyslogConfig{
+		SpoolDir:         dir,
+		SpoolSegmentSize: 1024 * 1024,
+		SpoolMaxSize:     2 * 1024 * 1024,
+		SpoolSync:        config.SyncAlways,
+	}
+}
+
+func newBatch(contents ...string) []*batching.LogEntry {
+	entries := []*batching.LogEntry{}
+
+	for _, content := range contents {
+		entries = append(entries, batching.NewLogEntry(format.LogParts{"content": content, "timestamp": time.Now()}))
+	}
+
+	return entries
+}
+
+func collect(batches chan []*batching.LogEntry) batching.DispatchFunc {
+	return func(entries []*batching.LogEntry) {
+		batches <- entries
+	}
+}
+
+func receive(t *testing.T, batches chan []*batching.LogEntry) []string {
+	select {
+	case entries := <-batches:
+		contents := []string{}
+		for _, entry := range entries {
+			contents = append(contents, entry.Message)
+		}
+		return contents
+	case <-time.After(time.Second):
+		require.FailNow(t, "batch wasn't dispatched")
+	}
+
+	return nil
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	require.Nil(t, err)
+
+	return files
+}
+
+func Test_WhenAppendAndRun(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	go s.Run()
+
+	acked := []error{}
+
+	batch := newBatch("one", "two")
+	batch[0].Ack = func(err error) { acked = append(acked, err) }
+
+	s.Append(batch)
+	s.Append(newBatch("three"))
+
+	// entries are acknowledged once they're written
+	require.Equal(t, []error{nil}, acked)
+
+	require.Equal(t, []string{"one", "two"}, receive(t, batches))
+	require.Equal(t, []string{"three"}, receive(t, batches))
+}
+
+func Test_WhenReopened(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+
+	batch := newBatch("one")
+	encoded, err := batch[0].Encoded()
+	require.Nil(t, err)
+
+	s.Append(batch)
+	s.Append(newBatch("two"))
+	require.Nil(t, s.Close())
+
+	// batches which weren't dispatched are replayed
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+
+	go s.Run()
+
+	select {
+	case entries := <-batches:
+		require.Len(t, entries, 1)
+		require.Equal(t, batch[0].MilliTimestamp, entries[0].MilliTimestamp)
+
+		data, err := entries[0].Encoded()
+		require.Nil(t, err)
+		require.Equal(t, string(encoded), string(data))
+	case <-time.After(time.Second):
+		require.FailNow(t, "batch wasn't dispatched")
+	}
+
+	require.Equal(t, []string{"two"}, receive(t, batches))
+	require.Nil(t, s.Close())
+
+	// batches which were dispatched aren't replayed
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	go s.Run()
+
+	s.Append(newBatch("three"))
+
+	require.Equal(t, []string{"three"}, receive(t, batches))
+	require.Len(t, segmentFiles(t, sc.SpoolDir), 1)
+}
+
+func Test_WhenDispatchFails(t *testing.T) {
+	sc := newSpoolConfig(t)
+	sc.RetryBaseDelay = time.Millisecond
+	sc.RetryMaxDelay = 10 * time.Millisecond
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+	failures := 1
+
+	// the second entry fails to be delivered the first time
+	dispatch := func(entries []*batching.LogEntry) {
+		for _, entry := range entries {
+			var err error
+			if entry.Message == "two" && failures > 0 {
+				failures--
+				err = errors.New("upload failed")
+			}
+
+			entry.Ack(err)
+		}
+
+		batches <- entries
+	}
+
+	s, err := Open(sc, dispatch)
+	require.Nil(t, err)
+
+	go s.Run()
+
+	s.Append(newBatch("one", "two"))
+
+	// only the entry which failed is retried
+	require.Equal(t, []string{"one", "two"}, receive(t, batches))
+	require.Equal(t, []string{"two"}, receive(t, batches))
+	require.Nil(t, s.Close())
+
+	// batches which were delivered after retrying aren't replayed
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+
+	go s.Run()
+
+	s.Append(newBatch("three"))
+
+	require.Equal(t, []string{"three"}, receive(t, batches))
+	require.Nil(t, s.Close())
+
+	// batches which haven't been delivered when the spool is closed are replayed
+	s, err = Open(sc, func(entries []*batching.LogEntry) {
+		batching.AckEntries(entries, errors.New("upload failed"))
+
+		select {
+		case batches <- entries:
+		default:
+		}
+	})
+	require.Nil(t, err)
+
+	go s.Run()
+
+	s.Append(newBatch("four"))
+
+	require.Equal(t, []string{"four"}, receive(t, batches))
+	require.Nil(t, s.Close())
+
+	for len(batches) > 0 {
+		<-batches
+	}
+
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	go s.Run()
+
+	require.Equal(t, []string{"four"}, receive(t, batches))
+}
+
+type permanentError struct{}
+
+func (permanentError) Error() string   { return "event rejected" }
+func (permanentError) Retriable() bool { return false }
+
+func Test_WhenDispatchNotRetriable(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	// entries which can never be delivered are dropped rather than retried
+	s, err := Open(sc, func(entries []*batching.LogEntry) {
+		batching.AckEntries(entries, fmt.Errorf("upload failed: %w", permanentError{}))
+		batches <- entries
+	})
+	require.Nil(t, err)
+
+	go s.Run()
+
+	s.Append(newBatch("one"))
+	s.Append(newBatch("two"))
+
+	// later batches aren't held up
+	require.Equal(t, []string{"one"}, receive(t, batches))
+	require.Equal(t, []string{"two"}, receive(t, batches))
+	require.Nil(t, s.Close())
+	require.Len(t, batches, 0)
+
+	// dropped batches aren't replayed
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	go s.Run()
+
+	s.Append(newBatch("three"))
+
+	require.Equal(t, []string{"three"}, receive(t, batches))
+}
+
+func Test_WhenSegmentsRotate(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	sc.SpoolSegmentSize = 100
+	sc.SpoolMaxSize = 1024 * 1024
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Append(newBatch("one"))
+	s.Append(newBatch("two"))
+	s.Append(newBatch("three"))
+
+	require.Len(t, segmentFiles(t, sc.SpoolDir), 3)
+
+	go s.Run()
+
+	require.Equal(t, []string{"one"}, receive(t, batches))
+	require.Equal(t, []string{"two"}, receive(t, batches))
+	require.Equal(t, []string{"three"}, receive(t, batches))
+
+	// the writer appends the next batch to the segment the reader is waiting on
+	s.Append(newBatch("four"))
+	require.Equal(t, []string{"four"}, receive(t, batches))
+
+	require.Len(t, segmentFiles(t, sc.SpoolDir), 1)
+}
+
+func Test_WhenSegmentCorrupt(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+
+	s.Append(newBatch("one"))
+	require.Nil(t, s.Close())
+
+	files := segmentFiles(t, sc.SpoolDir)
+	require.Len(t, files, 1)
+
+	// a record partly written before a crash
+	file, err := os.OpenFile(files[0], os.O_WRONLY|os.O_APPEND, 0600)
+	require.Nil(t, err)
+	_, err = file.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{'})
+	require.Nil(t, err)
+	require.Nil(t, file.Close())
+
+	s, err = Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	go s.Run()
+
+	s.Append(newBatch("two"))
+
+	require.Equal(t, []string{"one"}, receive(t, batches))
+	require.Equal(t, []string{"two"}, receive(t, batches))
+}
+
+func Test_WhenSpoolFull(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	sc.SpoolSegmentSize = 100
+	sc.SpoolMaxSize = 200
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+	defer s.Close()
+
+	s.Append(newBatch("one"))
+	s.Append(newBatch("two"))
+
+	appended := make(chan struct{})
+
+	go func() {
+		s.Append(newBatch("three"))
+		close(appended)
+	}()
+
+	select {
+	case <-appended:
+		require.FailNow(t, "append didn't wait for space")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	go s.Run()
+
+	select {
+	case <-appended:
+	case <-time.After(time.Second):
+		require.FailNow(t, "append wasn't released")
+	}
+
+	require.Equal(t, []string{"one"}, receive(t, batches))
+	require.Equal(t, []string{"two"}, receive(t, batches))
+	require.Equal(t, []string{"three"}, receive(t, batches))
+}
+
+func Test_WhenSpoolClosed(t *testing.T) {
+	sc := newSpoolConfig(t)
+	defer os.RemoveAll(sc.SpoolDir)
+
+	batches := make(chan []*batching.LogEntry, 10)
+
+	s, err := Open(sc, collect(batches))
+	require.Nil(t, err)
+	require.Nil(t, s.Close())
+
+	// batches which can't be written are dispatched directly
+	s.Append(newBatch("one"))
+
+	require.Equal(t, []string{"one"}, receive(t, batches))
+}
@@ -0,0 +1,133 @@
+package tlsconfig
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+var rejectedHandshakes = expvar.NewMap("tls_rejected_handshakes")
+
+type clientMatch struct {
+	kind  string
+	value string
+}
+
+// ClientACL allow and deny lists which are checked against the verified client certificate
+type ClientACL struct {
+	listener string
+	allow    []clientMatch
+	deny     []clientMatch
+}
+
+// NewClientACL create a new client ACL from lists of matches in the form kind:value
+func NewClientACL(listener string, allow, deny []string) (*ClientACL, error) {
+	acl := &ClientACL{listener: listener}
+
+	var err error
+
+	acl.allow, err = parseClientMatches(allow)
+	if err != nil {
+		return nil, err
+	}
+
+	acl.deny, err = parseClientMatches(deny)
+	if err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// Check returns an error if the certificate is denied, or an allow list is configured and it isn't on it
+func (a *ClientACL) Check(cert *x509.Certificate) error {
+	for _, m := range a.deny {
+		if matches(m, cert) {
+			return fmt.Errorf("client certificate is denied by %s:%s", m.kind, m.value)
+		}
+	}
+
+	if len(a.allow) == 0 {
+		return nil
+	}
+
+	for _, m := range a.allow {
+		if matches(m, cert) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("client certificate is not allowed")
+}
+
+// VerifyConnection checks the client certificate, this is called after the normal certificate verification of
+// each handshake, including those resuming a session, so clients denied since the session began are rejected
+func (a *ClientACL) VerifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+
+	err := a.Check(cert)
+	if err != nil {
+		rejectedHandshakes.Add(a.listener, 1)
+
+		logrus.WithError(err).WithFields(logrus.Fields{
+			"listener":    a.listener,
+			"subject":     cert.Subject.String(),
+			"fingerprint": fingerprint(cert),
+		}).Warn("client certificate rejected")
+
+		return err
+	}
+
+	return nil
+}
+
+func parseClientMatches(values []string) ([]clientMatch, error) {
+	matches := make([]clientMatch, len(values))
+
+	for n, value := range values {
+		kind, value, err := config.ParseClientMatch(value)
+		if err != nil {
+			return nil, err
+		}
+
+		matches[n] = clientMatch{kind: kind, value: value}
+	}
+
+	return matches, nil
+}
+
+func matches(m clientMatch, cert *x509.Certificate) bool {
+	switch m.kind {
+	case config.ClientMatchCN:
+		return cert.Subject.CommonName == m.value
+	case config.ClientMatchURI:
+		for _, uri := range cert.URIs {
+			if uri.String() == m.value {
+				return true
+			}
+		}
+	case config.ClientMatchSHA256:
+		return fingerprint(cert) == m.value
+	}
+
+	return false
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	return fingerprintDER(cert.Raw)
+}
+
+func fingerprintDER(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
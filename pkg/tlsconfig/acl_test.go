@@ -0,0 +1,65 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenClientACLEmpty(t *testing.T) {
+	ca := newTestCA(t)
+	client := newTestClient(t, ca, 2, "apigee-prod")
+
+	acl, err := NewClientACL("test", nil, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, acl.Check(client.cert))
+}
+
+func Test_WhenClientACLAllow(t *testing.T) {
+	ca := newTestCA(t)
+	prod := newTestClient(t, ca, 2, "apigee-prod")
+	test := newTestClient(t, ca, 3, "apigee-test", "spiffe://apigee/test")
+	dev := newTestClient(t, ca, 4, "apigee-dev")
+
+	acl, err := NewClientACL("test", []string{
+		"cn:apigee-prod",
+		"uri:spiffe://apigee/test",
+		"sha256:" + fingerprint(dev.cert),
+	}, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, acl.Check(prod.cert))
+	require.Nil(t, acl.Check(test.cert))
+	require.Nil(t, acl.Check(dev.cert))
+
+	other := newTestClient(t, ca, 5, "apigee-other")
+	require.Error(t, acl.Check(other.cert))
+}
+
+func Test_WhenClientACLDeny(t *testing.T) {
+	ca := newTestCA(t)
+	prod := newTestClient(t, ca, 2, "apigee-prod")
+	leaked := newTestClient(t, ca, 3, "apigee-prod")
+
+	acl, err := NewClientACL("test", []string{"cn:apigee-prod"}, []string{"sha256:" + fingerprint(leaked.cert)})
+	require.Nil(t, err)
+
+	require.Nil(t, acl.Check(prod.cert))
+
+	err = acl.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaked.cert, ca.cert}})
+	require.Error(t, err)
+
+	// connections without a client certificate are left to the client certificate mode
+	require.Nil(t, acl.VerifyConnection(tls.ConnectionState{}))
+}
+
+func Test_WhenClientACLInvalid(t *testing.T) {
+	_, err := NewClientACL("test", []string{"ou:platform"}, nil)
+	require.Error(t, err)
+
+	_, err = NewClientACL("test", nil, []string{"apigee-prod"})
+	require.Error(t, err)
+}
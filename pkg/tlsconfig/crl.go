@@ -0,0 +1,250 @@
+package tlsconfig
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CRLChecker rejects client certificates which appear on a certificate revocation list from their issuer
+type CRLChecker struct {
+	listener string
+	issuers  func() ([]byte, error)
+	crls     [][]byte
+	files    []string
+	lock     sync.RWMutex
+	revoked  map[string]bool
+}
+
+// NewCRLChecker create a new checker from CRL data and files containing CRLs, each CRL must be signed by one
+// of the PEM encoded CAs returned by issuers, the CAs and files are re-read when calling Load
+func NewCRLChecker(listener string, issuers func() ([]byte, error), crls [][]byte, files []string) (*CRLChecker, error) {
+	c := &CRLChecker{
+		listener: listener,
+		issuers:  issuers,
+		crls:     crls,
+		files:    files,
+		revoked:  map[string]bool{},
+	}
+
+	err := c.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Load parse all the CRLs, verifying them against the client CAs, and replace the set of revoked certificates
+func (c *CRLChecker) Load() error {
+	revoked := map[string]bool{}
+
+	var issuers []*x509.Certificate
+
+	// the client CA is only needed to verify the CRLs
+	if len(c.crls) > 0 || len(c.files) > 0 {
+		var err error
+
+		issuers, err = c.loadIssuers()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, data := range c.crls {
+		err := addRevoked(revoked, issuers, data)
+		if err != nil {
+			return errors.Wrap(err, "failed to parse certificate revocation list from config")
+		}
+	}
+
+	for _, file := range c.files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read certificate revocation list %s", file)
+		}
+
+		err = addRevoked(revoked, issuers, data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse certificate revocation list %s", file)
+		}
+	}
+
+	c.lock.Lock()
+	c.revoked = revoked
+	c.lock.Unlock()
+
+	return nil
+}
+
+// Refresh reload the CRLs on each interval, keeping the previous CRLs if they fail to load
+func (c *CRLChecker) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := c.Load()
+		if err != nil {
+			logrus.WithError(err).WithField("listener", c.listener).Error("certificate revocation list refresh failed")
+			continue
+		}
+
+		logrus.WithField("listener", c.listener).Debug("certificate revocation lists refreshed")
+	}
+}
+
+// Check returns an error if the certificate serial number has been revoked by its issuer
+func (c *CRLChecker) Check(cert *x509.Certificate) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	if c.revoked[revocationKey(cert.RawIssuer, cert.SerialNumber)] {
+		return fmt.Errorf("client certificate serial %s issued by %s is revoked", cert.SerialNumber, cert.Issuer)
+	}
+
+	return nil
+}
+
+// VerifyConnection checks the certificates of each verified chain, this is called after the normal certificate
+// verification of each handshake, including those resuming a session, so certificates revoked since are rejected
+func (c *CRLChecker) VerifyConnection(state tls.ConnectionState) error {
+	chains := state.VerifiedChains
+
+	// resumed sessions may only have the certificates the client presented
+	if len(chains) == 0 && len(state.PeerCertificates) > 0 {
+		chains = [][]*x509.Certificate{state.PeerCertificates}
+	}
+
+	for _, chain := range chains {
+		for _, cert := range chain {
+			err := c.Check(cert)
+			if err != nil {
+				rejectedHandshakes.Add(c.listener, 1)
+
+				logrus.WithError(err).WithFields(logrus.Fields{
+					"listener":    c.listener,
+					"subject":     cert.Subject.String(),
+					"fingerprint": fingerprint(cert),
+				}).Warn("client certificate rejected")
+
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// loadIssuers parse the client CAs which may sign the CRLs
+func (c *CRLChecker) loadIssuers() ([]*x509.Certificate, error) {
+	if c.issuers == nil {
+		return nil, errors.New("certificate revocation lists require a client CA to verify them")
+	}
+
+	data, err := c.issuers()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load client CA to verify certificate revocation lists")
+	}
+
+	issuers := []*x509.Certificate{}
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse client CA to verify certificate revocation lists")
+		}
+
+		issuers = append(issuers, cert)
+	}
+
+	if len(issuers) == 0 {
+		return nil, errors.New("certificate revocation lists require a client CA to verify them")
+	}
+
+	return issuers, nil
+}
+
+// addRevoked parse PEM, which may contain a number of CRLs, or DER data and add the revoked certificates
+func addRevoked(revoked map[string]bool, issuers []*x509.Certificate, data []byte) error {
+	if !bytes.Contains(data, []byte("-----BEGIN")) {
+		return addRevokedDER(revoked, issuers, data)
+	}
+
+	for {
+		var block *pem.Block
+
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil
+		}
+
+		if block.Type != "X509 CRL" {
+			continue
+		}
+
+		err := addRevokedDER(revoked, issuers, block.Bytes)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func addRevokedDER(revoked map[string]bool, issuers []*x509.Certificate, der []byte) error {
+	crl, err := x509.ParseDERCRL(der)
+	if err != nil {
+		return err
+	}
+
+	issuer := crlIssuer(issuers, crl)
+	if issuer == nil {
+		return fmt.Errorf("certificate revocation list issued by %s isn't signed by a client CA", crl.TBSCertList.Issuer)
+	}
+
+	if crl.HasExpired(time.Now()) {
+		logrus.WithField("issuer", crl.TBSCertList.Issuer.String()).Warn("certificate revocation list has expired")
+	}
+
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[revocationKey(issuer.RawSubject, cert.SerialNumber)] = true
+	}
+
+	return nil
+}
+
+// crlIssuer returns the CA which signed the CRL, or nil if none of them did
+func crlIssuer(issuers []*x509.Certificate, crl *pkix.CertificateList) *x509.Certificate {
+	for _, issuer := range issuers {
+		if issuer.KeyUsage != 0 && issuer.KeyUsage&x509.KeyUsageCRLSign == 0 {
+			continue
+		}
+
+		if issuer.CheckCRLSignature(crl) == nil {
+			return issuer
+		}
+	}
+
+	return nil
+}
+
+// revocationKey identifies a certificate by its issuer and serial number, serials are only unique per issuer
+func revocationKey(rawIssuer []byte, serial *big.Int) string {
+	return string(rawIssuer) + "/" + serial.String()
+}
@@ -0,0 +1,143 @@
+package tlsconfig
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenCRLCheckerFromData(t *testing.T) {
+	ca := newTestCA(t)
+	client := newTestClient(t, ca, 2, "apigee-prod")
+	revoked := newTestClient(t, ca, 3, "apigee-prod")
+
+	crl := newTestCRL(t, ca, revoked)
+
+	checker, err := NewCRLChecker("test", testIssuers(ca), [][]byte{crl}, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, checker.Check(client.cert))
+	require.Error(t, checker.Check(revoked.cert))
+
+	err = checker.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{revoked.cert, ca.cert}}})
+	require.Error(t, err)
+
+	// resumed sessions may only have the presented certificates
+	err = checker.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{revoked.cert}})
+	require.Error(t, err)
+}
+
+func Test_WhenCRLCheckerFromFile(t *testing.T) {
+	ca := newTestCA(t)
+	first := newTestClient(t, ca, 2, "apigee-prod")
+	second := newTestClient(t, ca, 3, "apigee-prod")
+
+	f, err := ioutil.TempFile("", "crl")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	writeTestCRLFile(t, f.Name(), newTestCRL(t, ca, first))
+
+	checker, err := NewCRLChecker("test", testIssuers(ca), nil, []string{f.Name()})
+	require.Nil(t, err)
+
+	require.Error(t, checker.Check(first.cert))
+	require.Nil(t, checker.Check(second.cert))
+
+	writeTestCRLFile(t, f.Name(), newTestCRL(t, ca, first), newTestCRL(t, ca, second))
+
+	err = checker.Load()
+	require.Nil(t, err)
+
+	require.Error(t, checker.Check(first.cert))
+	require.Error(t, checker.Check(second.cert))
+}
+
+func Test_WhenCRLCheckerInvalid(t *testing.T) {
+	ca := newTestCA(t)
+
+	_, err := NewCRLChecker("test", testIssuers(ca), [][]byte{[]byte("abc")}, nil)
+	require.Error(t, err)
+
+	_, err = NewCRLChecker("test", testIssuers(ca), nil, []string{"/does/not/exist"})
+	require.Error(t, err)
+
+	// CRLs can't be verified without a client CA
+	_, err = NewCRLChecker("test", nil, [][]byte{newTestCRL(t, ca)}, nil)
+	require.Error(t, err)
+}
+
+func Test_WhenCRLCheckerIssuers(t *testing.T) {
+	ca := newTestCA(t)
+	other := newTestCert(t, nil, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "other ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	})
+
+	// CRLs which aren't signed by a client CA are rejected
+	_, err := NewCRLChecker("test", testIssuers(ca), [][]byte{newTestCRL(t, other)}, nil)
+	require.Error(t, err)
+
+	// a serial revoked by one CA doesn't revoke the same serial issued by another
+	client := newTestClient(t, ca, 2, "apigee-prod")
+	otherClient := newTestClient(t, other, 2, "apigee-prod")
+
+	checker, err := NewCRLChecker("test", testIssuers(ca, other), [][]byte{newTestCRL(t, other, otherClient)}, nil)
+	require.Nil(t, err)
+
+	require.Nil(t, checker.Check(client.cert))
+	require.Error(t, checker.Check(otherClient.cert))
+
+	// each certificate in the chain is only checked against the CRLs of its own issuer
+	require.Nil(t, checker.VerifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{client.cert, ca.cert}}}))
+}
+
+func testIssuers(cas ...*testCert) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		data := []byte{}
+		for _, ca := range cas {
+			data = append(data, ca.certPEM()...)
+		}
+
+		return data, nil
+	}
+}
+
+func newTestCRL(t *testing.T, ca *testCert, revoked ...*testCert) []byte {
+	certs := make([]pkix.RevokedCertificate, len(revoked))
+
+	for n, rc := range revoked {
+		certs[n] = pkix.RevokedCertificate{
+			SerialNumber:   rc.cert.SerialNumber,
+			RevocationTime: time.Now(),
+		}
+	}
+
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, certs, time.Now(), time.Now().Add(1*time.Hour))
+	require.Nil(t, err)
+
+	return der
+}
+
+func writeTestCRLFile(t *testing.T, name string, crls ...[]byte) {
+	data := []byte{}
+
+	for _, crl := range crls {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})...)
+	}
+
+	err := ioutil.WriteFile(name, data, 0600)
+	require.Nil(t, err)
+}
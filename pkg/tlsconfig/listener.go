@@ -0,0 +1,115 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"expvar"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var handshakeTimeouts = expvar.NewMap("tls_handshake_timeouts")
+
+// Listener performs the TLS handshake of each accepted connection concurrently, returning only connections
+// which complete the handshake within the timeout so slow clients can't hold up accepting other connections
+type Listener struct {
+	net.Listener
+	name    string
+	config  *tls.Config
+	timeout time.Duration
+	conns   chan net.Conn
+	errs    chan error
+	done    chan struct{}
+	start   sync.Once
+	stop    sync.Once
+}
+
+// NewListener wrap the listener with TLS, name is the listener name used when recording handshake timeouts
+// and a timeout of zero allows handshakes to take as long as the client likes
+func NewListener(ln net.Listener, name string, config *tls.Config, timeout time.Duration) *Listener {
+	return &Listener{
+		Listener: ln,
+		name:     name,
+		config:   config,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+}
+
+// Accept waits for and returns the next connection to complete the handshake, the connection is a *tls.Conn
+func (l *Listener) Accept() (net.Conn, error) {
+	l.start.Do(func() { go l.accept() })
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errors.New("listener closed")
+	}
+}
+
+// Close stop accepting connections
+func (l *Listener) Close() error {
+	l.stop.Do(func() { close(l.done) })
+
+	return l.Listener.Close()
+}
+
+func (l *Listener) accept() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+
+			return
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+func (l *Listener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.config)
+
+	if l.timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(l.timeout))
+	}
+
+	err := tlsConn.Handshake()
+	if err != nil {
+		fields := logrus.Fields{"listener": l.name, "client": conn.RemoteAddr().String()}
+
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			handshakeTimeouts.Add(l.name, 1)
+			logrus.WithFields(fields).WithField("timeout", l.timeout.String()).Warn("TLS handshake timed out, closing connection")
+		} else {
+			logrus.WithError(err).WithFields(fields).Debug("TLS handshake failed")
+		}
+
+		conn.Close()
+		return
+	}
+
+	tlsConn.SetDeadline(time.Time{})
+
+	select {
+	case l.conns <- tlsConn:
+	case <-l.done:
+		conn.Close()
+	}
+}
@@ -0,0 +1,73 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_WhenListenerHandshakeTimeout(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	client := newTestClient(t, ca, 3, "apigee-prod")
+
+	store, err := NewStore(newTestListenerConfig(t, ca, server))
+	require.Nil(t, err)
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := NewListener(raw, "test", store.Config(), 100*time.Millisecond)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			// the handshake is complete before the connection is returned
+			require.True(t, conn.(*tls.Conn).ConnectionState().HandshakeComplete)
+
+			conn.Write([]byte("ok"))
+			conn.Close()
+		}
+	}()
+
+	// a client which never starts the handshake doesn't prevent other clients connecting
+	slow, err := net.Dial("tcp", raw.Addr().String())
+	require.Nil(t, err)
+	defer slow.Close()
+
+	err = testHandshake(t, raw.Addr().String(), ca, client)
+	require.Nil(t, err)
+
+	// and is closed once the timeout expires
+	slow.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	data, err := ioutil.ReadAll(slow)
+	require.Nil(t, err)
+	require.Empty(t, data)
+}
+
+func Test_WhenListenerClosed(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+
+	ln := NewListener(raw, "test", &tls.Config{}, time.Second)
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := ln.Accept()
+		accepted <- err
+	}()
+
+	ln.Close()
+
+	require.Error(t, <-accepted)
+}
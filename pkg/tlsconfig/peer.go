@@ -0,0 +1,84 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// DefaultPeerName used when the client certificate doesn't contain the configured identity
+const DefaultPeerName = "default"
+
+// PeerNameFunc returns a function which names the peer of a TLS connection using the configured
+// attribute of the verified client certificate, or the anonymous peer name when no certificate was supplied
+func PeerNameFunc(lc *config.ListenerConfig) func(tlsConn *tls.Conn) (string, bool) {
+	return func(tlsConn *tls.Conn) (string, bool) {
+		state := tlsConn.ConnectionState()
+
+		logrus.WithFields(logrus.Fields{
+			"listener": lc.Name,
+			"client":   tlsConn.RemoteAddr().String(),
+			"version":  config.TLSVersionName(state.Version),
+			"cipher":   tls.CipherSuiteName(state.CipherSuite),
+		}).Debug("TLS connection negotiated")
+
+		return StatePeerName(lc, state), true
+	}
+}
+
+// StatePeerName names the peer of a negotiated TLS connection, see PeerNameFunc
+func StatePeerName(lc *config.ListenerConfig, state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		if lc.AnonymousPeer != "" {
+			return lc.AnonymousPeer
+		}
+
+		return DefaultPeerName
+	}
+
+	return PeerName(state.PeerCertificates[0], lc.PeerName)
+}
+
+// PeerName returns the identity of the certificate using the given attribute, the common name when
+// no attribute is configured, falling back to the common name and then the default peer name when
+// the attribute isn't present
+func PeerName(cert *x509.Certificate, attribute string) string {
+	var name string
+
+	switch attribute {
+	case config.PeerNameSAN:
+		name = subjectAltName(cert)
+	case config.PeerNameOU:
+		if len(cert.Subject.OrganizationalUnit) > 0 {
+			name = cert.Subject.OrganizationalUnit[0]
+		}
+	}
+
+	if name == "" {
+		name = cert.Subject.CommonName
+	}
+
+	if name == "" {
+		name = DefaultPeerName
+	}
+
+	return name
+}
+
+func subjectAltName(cert *x509.Certificate) string {
+	if len(cert.URIs) > 0 {
+		return cert.URIs[0].String()
+	}
+
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+
+	if len(cert.EmailAddresses) > 0 {
+		return cert.EmailAddresses[0]
+	}
+
+	return ""
+}
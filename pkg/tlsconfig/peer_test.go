@@ -0,0 +1,46 @@
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func Test_WhenPeerName(t *testing.T) {
+	uri, _ := url.Parse("spiffe://apigee/prod")
+
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:         "apigee-prod",
+			OrganizationalUnit: []string{"platform"},
+		},
+		URIs:     []*url.URL{uri},
+		DNSNames: []string{"apigee.example.com"},
+	}
+
+	require.Equal(t, "apigee-prod", PeerName(cert, config.PeerNameCN))
+	require.Equal(t, "spiffe://apigee/prod", PeerName(cert, config.PeerNameSAN))
+	require.Equal(t, "platform", PeerName(cert, config.PeerNameOU))
+	require.Equal(t, "apigee-prod", PeerName(cert, ""))
+
+	cert.URIs = nil
+
+	require.Equal(t, "apigee.example.com", PeerName(cert, config.PeerNameSAN))
+}
+
+func Test_WhenPeerNameMissing(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName: "apigee-prod",
+		},
+	}
+
+	require.Equal(t, "apigee-prod", PeerName(cert, config.PeerNameSAN))
+	require.Equal(t, "apigee-prod", PeerName(cert, config.PeerNameOU))
+
+	require.Equal(t, DefaultPeerName, PeerName(&x509.Certificate{}, config.PeerNameCN))
+}
@@ -0,0 +1,178 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// Store holds the TLS configuration for a listener, the certificate, key and client CA
+// can be reloaded without restarting and are used for all new connections
+type Store struct {
+	lc     *config.ListenerConfig
+	acl    *ClientACL
+	crl    *CRLChecker
+	lock   sync.RWMutex
+	config *tls.Config
+	cert   string
+}
+
+// NewStore build the TLS configuration for a listener
+func NewStore(lc *config.ListenerConfig) (*Store, error) {
+	acl, err := NewClientACL(lc.Name, lc.AllowClients, lc.DenyClients)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to build client ACL from configuration")
+	}
+
+	crls, err := lc.ClientRevocationLists()
+	if err != nil {
+		return nil, err
+	}
+
+	crl, err := NewCRLChecker(lc.Name, lc.ClientCaCertificate, crls, lc.ClientCRLFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lc.ClientCRLFiles) > 0 && lc.CRLRefresh > 0 {
+		go crl.Refresh(lc.CRLRefresh)
+	}
+
+	s := &Store{lc: lc, acl: acl, crl: crl}
+
+	err = s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Config returns the TLS configuration for the listener which looks up the
+// current configuration from the store for each new connection
+func (s *Store) Config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: s.GetConfigForClient,
+	}
+}
+
+// GetConfigForClient returns the current TLS configuration
+func (s *Store) GetConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.config, nil
+}
+
+// Reload the certificate, key, client CA and revocation lists, if this fails the previous configuration is kept
+func (s *Store) Reload() error {
+	err := s.crl.Load()
+	if err != nil {
+		return err
+	}
+
+	return s.load()
+}
+
+// Refresh reload the store on each interval
+func (s *Store) Refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		err := s.Reload()
+		if err != nil {
+			logrus.WithError(err).WithField("listener", s.lc.Name).Error("TLS configuration refresh failed")
+		}
+	}
+}
+
+func (s *Store) load() error {
+	cert, err := s.lc.Certificate()
+	if err != nil {
+		return errors.Wrap(err, "failed to build certs from configuration")
+	}
+
+	var caCertPool *x509.CertPool
+
+	// the client CA is optional when client certificates aren't requested
+	if s.lc.ClientCaCert != "" || s.lc.ClientCaCertFile != "" {
+		caCert, err := s.lc.ClientCaCertificate()
+		if err != nil {
+			return errors.Wrap(err, "failed to build ca cert from configuration")
+		}
+
+		caCertPool = x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return errors.New("failed to parse ca cert from configuration")
+		}
+	}
+
+	minVersion, maxVersion, err := s.lc.TLSVersions()
+	if err != nil {
+		return err
+	}
+
+	cipherSuites, err := s.lc.TLSCipherSuiteIDs()
+	if err != nil {
+		return err
+	}
+
+	curves, err := s.lc.TLSCurveIDs()
+	if err != nil {
+		return err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert}, // server certificate which is validated by the client
+		ClientCAs:    caCertPool,              // used to verify the client cert is signed by the CA and is therefore valid
+		ClientAuth:   s.lc.TLSClientAuth(),    // by default this requires a valid client certificate to be supplied during handshake
+		// enforces the client allow and deny lists, and revocation lists, unlike VerifyPeerCertificate
+		// this is also called when resuming a session
+		VerifyConnection: verifyConnection(s.acl.VerifyConnection, s.crl.VerifyConnection),
+		MinVersion:       minVersion,
+		MaxVersion:       maxVersion,
+		CipherSuites:     cipherSuites,
+		CurvePreferences: curves,
+	}
+
+	if len(cipherSuites) > 0 {
+		config.PreferServerCipherSuites = true
+	}
+
+	// the fingerprint of the server certificate is used to log when it changes
+	fp := fingerprintDER(cert.Certificate[0])
+
+	s.lock.Lock()
+	previous := s.cert
+	s.config = config
+	s.cert = fp
+	s.lock.Unlock()
+
+	if previous != fp {
+		logrus.WithFields(logrus.Fields{
+			"listener":    s.lc.Name,
+			"fingerprint": fp,
+		}).Info("TLS certificate loaded")
+	}
+
+	return nil
+}
+
+type verifyFunc func(state tls.ConnectionState) error
+
+// verifyConnection chain a number of verify functions, returning the first error
+func verifyConnection(funcs ...verifyFunc) verifyFunc {
+	return func(state tls.ConnectionState) error {
+		for _, f := range funcs {
+			err := f(state)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
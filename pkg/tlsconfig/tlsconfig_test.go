@@ -0,0 +1,362 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func Test_WhenStoreReload(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+
+	lc := newTestListenerConfig(t, ca, server)
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	conf, err := store.GetConfigForClient(nil)
+	require.Nil(t, err)
+	require.Equal(t, server.cert.Raw, conf.Certificates[0].Certificate[0])
+
+	rotated := newTestClient(t, ca, 3, "localhost")
+	lc.Cert = base64.StdEncoding.EncodeToString(rotated.certPEM())
+	lc.Key = base64.StdEncoding.EncodeToString(rotated.keyPEM(t))
+
+	err = store.Reload()
+	require.Nil(t, err)
+
+	conf, err = store.GetConfigForClient(nil)
+	require.Nil(t, err)
+	require.Equal(t, rotated.cert.Raw, conf.Certificates[0].Certificate[0])
+
+	lc.Key = "abc"
+
+	err = store.Reload()
+	require.Error(t, err)
+
+	conf, err = store.GetConfigForClient(nil)
+	require.Nil(t, err)
+	require.Equal(t, rotated.cert.Raw, conf.Certificates[0].Certificate[0])
+}
+
+func Test_WhenStoreHandshake(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	allowed := newTestClient(t, ca, 3, "apigee-prod")
+	denied := newTestClient(t, ca, 4, "apigee-test")
+
+	lc := newTestListenerConfig(t, ca, server)
+	lc.AllowClients = []string{"cn:apigee-prod"}
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", store.Config())
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				err := conn.(*tls.Conn).Handshake()
+				if err == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	err = testHandshake(t, ln.Addr().String(), ca, allowed)
+	require.Nil(t, err)
+
+	err = testHandshake(t, ln.Addr().String(), ca, denied)
+	require.Error(t, err)
+}
+
+func Test_WhenStoreResumedSession(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	client := newTestClient(t, ca, 3, "apigee-prod")
+
+	store, err := NewStore(newTestListenerConfig(t, ca, server))
+	require.Nil(t, err)
+
+	addr := testServer(t, store)
+	cache := tls.NewLRUClientSessionCache(1)
+
+	resumed, err := testSession(t, addr, ca, client, cache)
+	require.Nil(t, err)
+	require.False(t, resumed)
+
+	resumed, err = testSession(t, addr, ca, client, cache)
+	require.Nil(t, err)
+	require.True(t, resumed)
+
+	// clients denied after their session began can't resume it
+	store.acl, err = NewClientACL("test", nil, []string{"cn:apigee-prod"})
+	require.Nil(t, err)
+	require.Nil(t, store.Reload())
+
+	_, err = testSession(t, addr, ca, client, cache)
+	require.Error(t, err)
+}
+
+func Test_WhenStoreResumedSessionRevoked(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	client := newTestClient(t, ca, 3, "apigee-prod")
+
+	f, err := ioutil.TempFile("", "crl")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	writeTestCRLFile(t, f.Name(), newTestCRL(t, ca))
+
+	lc := newTestListenerConfig(t, ca, server)
+	lc.ClientCRLFiles = []string{f.Name()}
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	addr := testServer(t, store)
+	cache := tls.NewLRUClientSessionCache(1)
+
+	resumed, err := testSession(t, addr, ca, client, cache)
+	require.Nil(t, err)
+	require.False(t, resumed)
+
+	resumed, err = testSession(t, addr, ca, client, cache)
+	require.Nil(t, err)
+	require.True(t, resumed)
+
+	// clients revoked after their session began can't resume it
+	writeTestCRLFile(t, f.Name(), newTestCRL(t, ca, client))
+	require.Nil(t, store.Reload())
+
+	_, err = testSession(t, addr, ca, client, cache)
+	require.Error(t, err)
+}
+
+func Test_WhenStoreMinVersion(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	client := newTestClient(t, ca, 3, "apigee-prod")
+
+	lc := newTestListenerConfig(t, ca, server)
+	lc.TLSMinVersion = "1.3"
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	conf, err := store.GetConfigForClient(nil)
+	require.Nil(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), conf.MinVersion)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", store.Config())
+	require.Nil(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	cert, err := tls.X509KeyPair(client.certPEM(), client.keyPEM(t))
+	require.Nil(t, err)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	_, err = tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+		MaxVersion:   tls.VersionTLS12,
+	})
+	require.Error(t, err)
+}
+
+func Test_WhenStoreOptionalClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+	client := newTestClient(t, ca, 3, "apigee-prod")
+
+	lc := newTestListenerConfig(t, ca, server)
+	lc.ClientAuth = config.ClientAuthOptional
+	lc.AnonymousPeer = "anonymous"
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", store.Config())
+	require.Nil(t, err)
+	defer ln.Close()
+
+	peerNameFunc := PeerNameFunc(lc)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				tlsConn := conn.(*tls.Conn)
+
+				err := tlsConn.Handshake()
+				if err == nil {
+					name, _ := peerNameFunc(tlsConn)
+					conn.Write([]byte(name + "\n"))
+				}
+			}()
+		}
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	cert, err := tls.X509KeyPair(client.certPEM(), client.keyPEM(t))
+	require.Nil(t, err)
+
+	name := testPeerName(t, ln.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	require.Equal(t, "anonymous\n", name)
+
+	name = testPeerName(t, ln.Addr().String(), &tls.Config{RootCAs: pool, ServerName: "localhost", Certificates: []tls.Certificate{cert}})
+	require.Equal(t, "apigee-prod\n", name)
+}
+
+func Test_WhenStoreWithoutClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	server := newTestClient(t, ca, 2, "localhost")
+
+	lc := newTestListenerConfig(t, ca, server)
+	lc.ClientAuth = config.ClientAuthNone
+	lc.ClientCaCert = ""
+
+	store, err := NewStore(lc)
+	require.Nil(t, err)
+
+	conf, err := store.GetConfigForClient(nil)
+	require.Nil(t, err)
+	require.Equal(t, tls.NoClientCert, conf.ClientAuth)
+	require.Nil(t, conf.ClientCAs)
+}
+
+func testPeerName(t *testing.T, addr string, conf *tls.Config) string {
+	conn, err := tls.Dial("tcp", addr, conf)
+	require.Nil(t, err)
+	defer conn.Close()
+
+	data, err := ioutil.ReadAll(conn)
+	require.Nil(t, err)
+
+	return string(data)
+}
+
+func newTestListenerConfig(t *testing.T, ca, server *testCert) *config.ListenerConfig {
+	return &config.ListenerConfig{
+		Name:         "test",
+		Transport:    config.TransportTLS,
+		ClientCaCert: base64.StdEncoding.EncodeToString(ca.certPEM()),
+		Cert:         base64.StdEncoding.EncodeToString(server.certPEM()),
+		Key:          base64.StdEncoding.EncodeToString(server.keyPEM(t)),
+	}
+}
+
+func testHandshake(t *testing.T, addr string, ca, client *testCert) error {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	cert, err := tls.X509KeyPair(client.certPEM(), client.keyPEM(t))
+	require.Nil(t, err)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ServerName:   "localhost",
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// with TLS 1.3 the client certificate is verified after the client handshake completes, so
+	// wait for the server to either respond or reject the connection
+	_, err = conn.Read(make([]byte, 2))
+
+	return err
+}
+
+// testServer serve TLS connections using the store, responding to each with ok once the handshake completes
+func testServer(t *testing.T, store *Store) string {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", store.Config())
+	require.Nil(t, err)
+
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				err := conn.(*tls.Conn).Handshake()
+				if err == nil {
+					conn.Write([]byte("ok"))
+				}
+			}()
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+// testSession connect using the session cache, returning whether the session was resumed
+func testSession(t *testing.T, addr string, ca, client *testCert, cache tls.ClientSessionCache) (bool, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	cert, err := tls.X509KeyPair(client.certPEM(), client.keyPEM(t))
+	require.Nil(t, err)
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		RootCAs:            pool,
+		ServerName:         "localhost",
+		ClientSessionCache: cache,
+	})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// reading the response also receives the session ticket sent after a TLS 1.3 handshake
+	_, err = io.ReadFull(conn, make([]byte, 2))
+
+	return conn.ConnectionState().DidResume, err
+}
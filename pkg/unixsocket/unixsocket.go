@@ -0,0 +1,106 @@
+package unixsocket
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+// Listen create a listener on the UNIX stream socket at the path of the listener, with its permissions
+func Listen(lc *config.ListenerConfig) (net.Listener, error) {
+	err := RemoveStale(lc.Path, config.TransportUnix)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", lc.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create UNIX socket listener")
+	}
+
+	err = SetPermissions(lc)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return ln, nil
+}
+
+// RemoveStale remove a socket left at the path by a process which is no longer running, the path must
+// not be any other kind of file or a socket which is accepting connections
+func RemoveStale(path, network string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to check socket path")
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("socket path %s exists and isn't a socket", path)
+	}
+
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket path %s is in use", path)
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to remove stale socket")
+	}
+
+	return nil
+}
+
+// SetPermissions set the mode and group of the socket at the path of the listener
+func SetPermissions(lc *config.ListenerConfig) error {
+	mode, err := lc.FileMode()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(lc.Path, mode)
+	if err != nil {
+		return errors.Wrap(err, "failed to set socket mode")
+	}
+
+	if lc.SocketGroup == "" {
+		return nil
+	}
+
+	gid, err := LookupGroup(lc.SocketGroup)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chown(lc.Path, -1, gid)
+	if err != nil {
+		return errors.Wrap(err, "failed to set socket group")
+	}
+
+	return nil
+}
+
+// LookupGroup returns the ID of the group with the name, or the ID itself if it's numeric
+func LookupGroup(group string) (int, error) {
+	gid, err := strconv.Atoi(group)
+	if err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to find socket group %s", group)
+	}
+
+	return strconv.Atoi(g.Gid)
+}
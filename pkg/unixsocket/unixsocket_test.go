@@ -0,0 +1,89 @@
+package unixsocket
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/versent/syslog-cloudlogs/pkg/config"
+)
+
+func Test_WhenListen(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	lc := &config.ListenerConfig{
+		Name:        "local",
+		Transport:   config.TransportUnix,
+		Path:        filepath.Join(dir, "log.sock"),
+		SocketMode:  "0600",
+		SocketGroup: strconvGid(),
+	}
+
+	ln, err := Listen(lc)
+	require.Nil(t, err)
+	defer ln.Close()
+
+	info, err := os.Stat(lc.Path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	conn, err := net.Dial("unix", lc.Path)
+	require.Nil(t, err)
+	conn.Close()
+
+	// the socket is in use
+	_, err = Listen(lc)
+	require.Error(t, err)
+}
+
+func Test_WhenRemoveStale(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "log.sock")
+
+	// nothing to remove
+	require.Nil(t, RemoveStale(path, "unixgram"))
+
+	conn, err := net.ListenPacket("unixgram", path)
+	require.Nil(t, err)
+
+	require.Error(t, RemoveStale(path, "unixgram"), "socket is in use")
+
+	// closing a datagram socket leaves the file behind
+	conn.Close()
+
+	require.Nil(t, RemoveStale(path, "unixgram"))
+
+	_, err = os.Lstat(path)
+	require.True(t, os.IsNotExist(err))
+
+	file := filepath.Join(dir, "file")
+	require.Nil(t, ioutil.WriteFile(file, []byte("abc"), 0600))
+	require.Error(t, RemoveStale(file, "unixgram"), "only sockets are removed")
+}
+
+func Test_WhenLookupGroup(t *testing.T) {
+	gid, err := LookupGroup("1234")
+	require.Nil(t, err)
+	require.Equal(t, 1234, gid)
+
+	_, err = LookupGroup("no-such-group-exists")
+	require.Error(t, err)
+}
+
+func testDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "unixsocket")
+	require.Nil(t, err)
+
+	return dir
+}
+
+func strconvGid() string {
+	return strconv.Itoa(os.Getgid())
+}